@@ -2,22 +2,58 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
-	"net"
-	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"pixivic/pixiv"
 	"pixivic/pixiv/strategy"
+)
+
+const usage = `P站爬虫, 具体操作详见博客: https://www.vergessen.top/article/v/9942142761049736
+
+用法:
+  pixiv [-config 配置文件] <命令> [参数] <关键字|ID...>
+  pixiv [-config 配置文件]  不带命令时进入交互模式, 从标准输入读取一行指令
+
+命令:
+  search    根据搜索关键字爬取图片, 多个单词会以空格连接为一个关键字
+  related   根据图片ID爬取相关图片, 多个ID以空格或逗号分隔
+  author    根据作者ID爬取该作者的所有图片
+  ranking   按日期范围爬取排行榜, 模式为 daily weekly monthly rookie original male female
+            开启 -r18 后可使用 daily_r18 weekly_r18 male_r18 female_r18 r18g
+  bookmarks 爬取当前账号的收藏, 可指定 public 或 private, 按收藏标签分组
+  follow    爬取关注用户上次运行以来的新作
+  organize  将目录中的图片按数量分批转移到统一的文件夹
+  wallpaper 将已下载的图片裁剪缩放为各目标分辨率的壁纸, 已生成的跳过
+
+使用 "pixiv <命令> -h" 查看命令的参数
 
-	"golang.org/x/net/proxy"
+配置文件为json格式, 默认读取 config.json, 可用环境变量 PIXIV_PROXY, PIXIV_CONCURRENCY,
+PIXIV_REQUESTS, PIXIV_TIMEOUT, PIXIV_IMAGE_DIR, PIXIV_COOKIE_FILE, PIXIV_BOOKMARKS,
+PIXIV_PIC_TYPE, PIXIV_RULES_FILE, PIXIV_DISPLAYS, PIXIV_WALLPAPERS 覆盖
+
+全局参数:
+`
+
+// 退出码
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
 )
 
 func main() {
@@ -26,80 +62,367 @@ func main() {
 	log.SetOutput(multiWriter)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
-	countdown := sync.WaitGroup{}
-	done := make(chan bool)
-	memo := make(map[string]bool)
-	dialer, _ := proxy.SOCKS5("tcp", "127.0.0.1:7890",
-		nil, &net.Dialer{
-			Timeout:   6000 * time.Second,
-			KeepAlive: 6000 * time.Second})
-	trans := &http.Transport{
-		Dial: dialer.Dial,
-	}
-	client := &http.Client{
-		Transport: trans,
-		Timeout:   time.Second * 6000, //超时时间
-	}
-	nowTime := time.Now()
-	// 获取Cookie
-	cookie := getCookie()
-	p := &pixiv.Pixiv{
-		GoroutinePool: make(chan struct{}, 30),          // 设置线程数量
-		PicChan:       make(chan *pixiv.PicDetail, 200), // 存储图片id的通道
-		RequestPool:   make(chan struct{}, 50),          // 通过DoRequest方法限制请求并发度
-		Client:        client,                           // http请求代理客户端
-		Cookie:        cookie,
-		CountDown:     &countdown, // 控制程序平稳结束的栅栏
-		Memo:          memo,       // 缓存，防止下载重复图片
-		Done:          done,       // 如果主动停止程序，依靠Done通知其他协程结束任务
-		CrawlStrategy: strategy.KeywordStrategy0,
-		R18:           false, // 默认不爬R18
-		EndTime:       &nowTime,
-		Mutex:         &sync.Mutex{},
-	}
-	// 加载缓存，防止下载之前的重复图片
-	getOldImg(memo)
+	global := flag.NewFlagSet("pixiv", flag.ContinueOnError)
+	configFile := global.String("config", "", "配置文件, 默认 config.json 或环境变量 PIXIV_CONFIG")
+	global.Usage = func() {
+		fmt.Fprint(global.Output(), usage)
+		global.PrintDefaults()
+	}
+	if err := global.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if global.Arg(0) == "help" {
+		global.SetOutput(os.Stdout)
+		global.Usage()
+		os.Exit(exitOK)
+	}
 
-	log.Println("具体操作详见博客: https://www.vergessen.top/article/v/9942142761049736")
-	log.Println("默认输入关键字爬取关键字对应的收藏数大于1000的图片")
-	input := bufio.NewScanner(os.Stdin)
-	var inputCtx string
-	if input.Scan() {
-		inputCtx = strings.ToLower(input.Text())
+	// 加载并校验配置
+	config, err := pixiv.LoadConfig(*configFile)
+	if err != nil {
+		log.Println("配置加载失败: ", err)
+		os.Exit(exitError)
 	}
+	log.Println("当前配置: " + config.String())
 
-	if initPixiv(p, inputCtx) {
-		// 设置输入任意字符退出,如回车
-		go func() {
-			for {
-				if input.Scan() {
-					scan := strings.ToLower(input.Text())
-					if scan == "q" {
-						log.Println("停止进程中, 程序将在执行完已提交任务后退出...")
-						done <- true
-						p.PicChan <- &pixiv.PicDetail{}
-						break
-					}
-				}
+	if global.NArg() == 0 {
+		interactive(config)
+		return
+	}
+	os.Exit(runCommand(config, global.Arg(0), global.Args()[1:]))
+}
+
+// 执行子命令, 返回退出码
+func runCommand(config *pixiv.Config, command string, args []string) int {
+	if command == "organize" {
+		return organize(args)
+	}
+	if command == "wallpaper" {
+		return wallpaper(config, args)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := newPixiv(ctx, config)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	late := bindFlags(flags, p, config)
+	graph := strategy.DefaultGraphOptions()
+	switch command {
+	case "search":
+		p.Strategy = strategy.Keyword
+		flags.StringVar(&p.SearchMode, "match", strategy.SearchTag, "标签匹配方式 full(s_tag_full): 完全一致 partial(s_tag): 部分一致 text(s_tc): 标题和说明")
+		flags.Usage = commandUsage(flags, "search [参数] <关键字...>",
+			"根据搜索关键字爬取图片, all 表示不限关键字\n"+
+				"-标签 表示排除, A|B 或 (A OR B) 表示任选其一, 多个搜索以分号分隔, 各自保存到单独的目录\n"+
+				"例如: pixiv search '风景 夜景|星空 -R-18; 猫'")
+	case "related":
+		flags.StringVar(&graph.Order, "order", graph.Order, "遍历顺序 bfs: 广度优先 best: 按收藏数和与种子相同的标签数优先")
+		flags.IntVar(&graph.MaxDepth, "depth", graph.MaxDepth, "最大深度, 种子的相关作品深度为1")
+		flags.IntVar(&graph.FanOut, "fanout", graph.FanOut, "每个作品获取的相关作品数")
+		flags.IntVar(&graph.Budget, "budget", graph.Budget, "每次运行最多访问的作品数, 0 表示不限制, 配合 -resume 下次继续")
+		flags.Usage = commandUsage(flags, "related [参数] <图片ID...>", "根据图片ID爬取相关图片")
+	case "author":
+		p.Strategy = strategy.Author
+		flags.Usage = commandUsage(flags, "author [参数] <作者ID>", "根据作者ID爬取该作者的所有图片")
+	case "ranking":
+		p.Strategy = strategy.Ranking
+		flags.Usage = commandUsage(flags, "ranking [参数] <模式>", "按日期范围爬取排行榜, 从 -end 向前爬取到 -start")
+	case "bookmarks":
+		p.Strategy = strategy.Bookmarks
+		flags.Usage = commandUsage(flags, "bookmarks [参数] [public|private]", "爬取当前账号的收藏, 默认公开和私密收藏都爬取")
+	case "follow":
+		p.Strategy = strategy.Follow
+		// 新作还没有收藏, 默认不要求收藏数
+		p.Bookmarks = 0
+		flags.Lookup("bookmarks").DefValue = "0"
+		flags.Usage = commandUsage(flags, "follow [参数]", "爬取关注用户上次运行以来的新作")
+	default:
+		fmt.Fprintln(os.Stderr, "未知命令: ", command)
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	if flags.NArg() == 0 && command != "bookmarks" && command != "follow" {
+		fmt.Fprintln(os.Stderr, "缺少关键字或ID")
+		flags.Usage()
+		return exitUsage
+	}
+
+	switch command {
+	case "search":
+		p.KeyWord = strings.Join(flags.Args(), " ")
+		if p.KeyWord == "all" {
+			p.KeyWord = ""
+		}
+		mode, ok := strategy.ParseSearchMode(p.SearchMode)
+		if !ok {
+			fmt.Fprintln(os.Stderr, "-match 只能为 full, partial 或 text: ", p.SearchMode)
+			return exitUsage
+		}
+		p.SearchMode = mode
+	case "related":
+		ids := strings.Split(strings.Join(flags.Args(), ","), ",")
+		for _, id := range ids {
+			if _, err := strconv.Atoi(id); err != nil {
+				fmt.Fprintln(os.Stderr, "图片ID必须为数字: ", id)
+				return exitUsage
 			}
-		}()
+		}
+		p.KeyWord = strings.Join(ids, ",")
+		if err := graph.Validate(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitUsage
+		}
+		p.Strategy = strategy.RelatedGraph(graph)
+	case "author":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "只能指定一个作者ID")
+			return exitUsage
+		}
+		if _, err := strconv.Atoi(flags.Arg(0)); err != nil {
+			fmt.Fprintln(os.Stderr, "作者ID必须为数字: ", flags.Arg(0))
+			return exitUsage
+		}
+		p.KeyWord = flags.Arg(0)
+	case "ranking":
+		mode := strings.ToLower(flags.Arg(0))
+		r18, ok := strategy.RankingModes[mode]
+		if !ok || flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "未知的排行榜模式: ", strings.Join(flags.Args(), " "))
+			return exitUsage
+		}
+		if r18 && !p.R18 {
+			fmt.Fprintln(os.Stderr, "R-18排行榜需要指定 -r18")
+			return exitUsage
+		}
+		p.KeyWord = mode
+	case "bookmarks":
+		rest := strings.ToLower(flags.Arg(0))
+		if flags.NArg() > 1 || (rest != "" && rest != "public" && rest != "private") {
+			fmt.Fprintln(os.Stderr, "只能指定 public 或 private: ", strings.Join(flags.Args(), " "))
+			return exitUsage
+		}
+		p.KeyWord = rest
+	case "follow":
+		if flags.NArg() > 0 {
+			fmt.Fprintln(os.Stderr, "follow 不需要参数: ", strings.Join(flags.Args(), " "))
+			return exitUsage
+		}
+	}
+	if err := late.apply(p); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	if err := run(ctx, config, p, nil); err != nil {
+		log.Println(err)
+		return exitError
+	}
+	return exitOK
+}
 
-		go func() {
-			for {
-				time.Sleep(time.Second * 3)
+// 子命令的帮助信息
+func commandUsage(flags *flag.FlagSet, use, desc string) func() {
+	return func() {
+		fmt.Fprintln(flags.Output(), "用法: pixiv "+use)
+		fmt.Fprintln(flags.Output(), desc)
+		fmt.Fprintln(flags.Output())
+		flags.PrintDefaults()
+	}
+}
+
+// 需要在参数解析之后才能生效的参数
+type lateFlags struct {
+	rules       string
+	displays    string
+	tolerance   float64
+	wallpapers  string
+	crop        string
+	startTime   string
+	endTime     string
+	pages       string
+	concurrency int
+	requests    int
+}
+
+// 绑定爬取相关的参数
+func bindFlags(flags *flag.FlagSet, p *pixiv.Pixiv, config *pixiv.Config) *lateFlags {
+	late := &lateFlags{}
+	flags.IntVar(&p.Bookmarks, "bookmarks", p.Bookmarks, "要求的最低收藏数")
+	flags.StringVar(&p.PicType, "type", p.PicType, "爬取的图片类型 w: 横屏 h: 竖屏 s: 小屏 o: 其他, 可组合")
+	flags.BoolVar(&p.R18, "r18", p.R18, "是否爬取R-18作品")
+	flags.IntVar(&p.RepetitionOdds, "repeat", p.RepetitionOdds, "重复下载已下载图片的概率 0 - 100")
+	flags.BoolVar(&p.Resume, "resume", p.Resume, "从上次中断的断点继续爬取")
+	flags.StringVar(&p.UgoiraFormat, "ugoira", p.UgoiraFormat, "动图合成格式 gif, apng, gif,apng 或 zip(只保存原始压缩包)")
+	flags.StringVar(&late.endTime, "end", "", "爬取时间终点, 格式 2006-01-02, 默认今天")
+	flags.StringVar(&late.startTime, "start", "", "爬取时间起点, 格式 2006-01-02, 目前只用于排行榜, 默认只爬终点当天")
+	flags.StringVar(&late.rules, "rules", "", "筛选规则文件, 指定后不再根据 -bookmarks, -type 和 -r18 筛选")
+	flags.StringVar(&late.displays, "displays", config.Displays, "目标显示器, 如 3840x2160,3440x1440,phone=1080x2400@0.1, 只爬取适合的作品并链接到 displays/<名称>")
+	flags.Float64Var(&late.tolerance, "tolerance", config.DisplayTolerance, "显示器宽高比的默认容差")
+	flags.StringVar(&late.wallpapers, "wallpapers", config.Wallpapers, "壁纸分辨率, 格式同 -displays, 下载后裁剪缩放到 wallpapers/<名称>, 原图保留")
+	flags.StringVar(&late.crop, "crop", config.WallpaperCrop, "壁纸裁剪方式 center: 居中 entropy: 信息熵最大 saliency: 边缘最多")
+	flags.StringVar(&late.pages, "pages", "1", "多图作品下载的页数, all 表示全部")
+	flags.IntVar(&late.concurrency, "concurrency", cap(p.GoroutinePool), "同时下载的图片数")
+	flags.IntVar(&late.requests, "requests", cap(p.RequestPool), "同时进行的接口请求数")
+	return late
+}
+
+// 校验并应用参数
+func (late *lateFlags) apply(p *pixiv.Pixiv) error {
+	p.PicType = strings.ToLower(p.PicType)
+	if p.RepetitionOdds < 0 || p.RepetitionOdds > 100 {
+		return fmt.Errorf("-repeat 必须在 0 - 100 之间: %d", p.RepetitionOdds)
+	}
+	if len(late.endTime) > 0 {
+		endTime, err := time.ParseInLocation("2006-01-02", late.endTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("-end 格式错误: %s", late.endTime)
+		}
+		p.EndTime = &endTime
+	}
+	if len(late.startTime) > 0 {
+		startTime, err := time.ParseInLocation("2006-01-02", late.startTime, time.Local)
+		if err != nil {
+			return fmt.Errorf("-start 格式错误: %s", late.startTime)
+		}
+		if startTime.After(*p.EndTime) {
+			return fmt.Errorf("-start 不能晚于 -end: %s", late.startTime)
+		}
+		p.StartTime = &startTime
+	}
+	if len(late.rules) > 0 {
+		rules, err := pixiv.LoadRules(late.rules)
+		if err != nil {
+			return err
+		}
+		p.Rules = rules
+	}
+	displays, err := pixiv.ParseDisplays(late.displays, late.tolerance)
+	if err != nil {
+		return err
+	}
+	p.Displays = displays
+	if p.Wallpaper, err = pixiv.ParseWallpaperOptions(late.wallpapers, late.crop); err != nil {
+		return err
+	}
+	if late.pages == "all" {
+		p.PageLimit = 0
+	} else {
+		pageLimit, err := strconv.Atoi(late.pages)
+		if err != nil || pageLimit < 1 {
+			return fmt.Errorf("-pages 必须为正整数或 all: %s", late.pages)
+		}
+		p.PageLimit = pageLimit
+	}
+	if late.concurrency < 1 || late.requests < 1 {
+		return fmt.Errorf("-concurrency 和 -requests 必须大于0")
+	}
+	p.GoroutinePool = make(chan struct{}, late.concurrency)
+	p.RequestPool = make(chan struct{}, late.requests)
+	return nil
+}
+
+// 根据配置创建带默认参数的爬虫, ctx结束时停止代理检查
+func newPixiv(ctx context.Context, config *pixiv.Config) (*pixiv.Pixiv, error) {
+	client, err := pixiv.NewClient(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return pixiv.New(
+		pixiv.WithConfig(config),
+		pixiv.WithClient(client), // http请求代理客户端
+		pixiv.WithStrategy(strategy.Keyword, ""),
+	), nil
+}
+
+// 执行爬取任务, input不为空时从中读取 q 来停止任务
+func run(ctx context.Context, config *pixiv.Config, p *pixiv.Pixiv, input *bufio.Scanner) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if input == nil {
+		input = bufio.NewScanner(os.Stdin)
+	}
+	// 设置输入q退出
+	go func() {
+		for input.Scan() {
+			scan := strings.ToLower(input.Text())
+			if scan == "q" {
+				log.Println("停止进程中, 正在中止未完成的任务...")
+				cancel()
+				break
+			}
+		}
+	}()
+	// Ctrl+C 同样停止任务
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			log.Println("停止进程中, 正在中止未完成的任务...")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	loadAccounts(ctx, config, p)
+
+	go func() {
+		ticker := time.NewTicker(time.Second * 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// 实际速率/当前允许的速率, 降速时括号中为设定速率
+				rate := ""
+				if p.Limiter != nil {
+					rate = " & 请求速率(次/秒): " + p.Limiter.String()
+				}
 				log.Println("爬取并发度: ", len(p.RequestPool), " & ",
-					"下载并发度: ", len(p.GoroutinePool))
+					"下载并发度: ", len(p.GoroutinePool), rate)
+			case <-ctx.Done():
+				return
 			}
-		}()
+		}
+	}()
 
-		// 开启根据关键词下载策略
-		p.GetUrls()
+	// 开启爬取策略和图片下载任务, 等待已经启动的任务结束
+	if err := p.Run(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
 
-		// 开启图片下载任务
-		p.CrawUrl()
+// 交互模式: 从标准输入读取一行指令
+func interactive(config *pixiv.Config) {
+	log.Println("具体操作详见博客: https://www.vergessen.top/article/v/9942142761049736")
+	log.Println("默认输入关键字爬取关键字对应的收藏数大于1000的图片")
+	input := bufio.NewScanner(os.Stdin)
+	var inputCtx string
+	if input.Scan() {
+		inputCtx = strings.ToLower(input.Text())
+	}
 
-		// 等待已经启动的任务结束
-		countdown.Wait()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := newPixiv(ctx, config)
+	if err != nil {
+		log.Println(err)
+	} else if initPixiv(p, inputCtx) {
+		if err := run(ctx, config, p, input); err != nil {
+			log.Println(err)
+		}
 	} else {
 		log.Println("输入参数有误！")
 	}
@@ -120,10 +443,17 @@ func initPixiv(p *pixiv.Pixiv, inputCtx string) bool {
 		keywords[0] = ""
 	}
 	p.KeyWord = keywords[0]
-	p.Bookmarks = 1000
-	p.PicType = "wh"
-	p.RepetitionOdds = 0
 	for _, keyword := range keywords[1:] {
+		if len(keyword) == 0 {
+			continue
+		}
+		if keyword == "-18" {
+			p.R18 = true
+			continue
+		}
+		if len(keyword) < 2 {
+			return false
+		}
 		switch keyword[:2] {
 		case "-b":
 			bookmarks, err := strconv.Atoi(keyword[2:])
@@ -136,56 +466,258 @@ func initPixiv(p *pixiv.Pixiv, inputCtx string) bool {
 		case "-r":
 			random, _ := strconv.Atoi(keyword[2:])
 			p.RepetitionOdds = int(math.Min(100, math.Max(0, float64(random))))
-		case "-18":
-			p.R18 = true
+		case "-p":
+			// -pall 下载多图作品的全部页, -pN 最多下载N页
+			if keyword[2:] == "all" {
+				p.PageLimit = 0
+				break
+			}
+			pageLimit, err := strconv.Atoi(keyword[2:])
+			if err != nil || pageLimit < 1 {
+				return false
+			}
+			p.PageLimit = pageLimit
+		case "-c":
+			// 从上次中断的位置继续爬取
+			p.Resume = true
+		case "-u":
+			// 动图合成格式 -ugif -uapng -ugif,apng, -uzip 只保存原始压缩包
+			p.UgoiraFormat = keyword[2:]
 		case "-e":
 			endTimeStr := keyword[2:]
-			endTime, _ := time.ParseInLocation("2006-01-02", endTimeStr, time.Local)
+			endTime, err := time.ParseInLocation("2006-01-02", endTimeStr, time.Local)
+			if err != nil {
+				return false
+			}
 			p.EndTime = &endTime
+		case "-m":
+			// 标签匹配方式 -mfull -mpartial -mtext
+			mode, ok := strategy.ParseSearchMode(keyword[2:])
+			if !ok {
+				return false
+			}
+			p.SearchMode = mode
+		case "-f":
+			// 排行榜的起始日期
+			startTime, err := time.ParseInLocation("2006-01-02", keyword[2:], time.Local)
+			if err != nil {
+				return false
+			}
+			p.StartTime = &startTime
 		case "-s":
 			switch keyword[2:] {
 			case "keyword":
-				p.CrawlStrategy = strategy.KeywordStrategy0
+				p.Strategy = strategy.Keyword
 				log.Println("即将根据搜索关键字爬取图片")
 			case "related":
-				p.CrawlStrategy = strategy.PicIdStrategy
+				p.Strategy = strategy.Related
 				log.Println("即将根据图片ID爬取相关图片")
 			case "author":
 				if _, err := strconv.Atoi(keywords[0]); err != nil {
 					return false
 				}
-				p.CrawlStrategy = strategy.AuthorStrategy
+				p.Strategy = strategy.Author
 				log.Println("即将根据作者ID爬取该作者的所有图片")
+			case "ranking":
+				if _, ok := strategy.RankingModes[keywords[0]]; !ok {
+					return false
+				}
+				p.Strategy = strategy.Ranking
+				log.Println("即将爬取排行榜")
+			case "bookmarks":
+				p.Strategy = strategy.Bookmarks
+				log.Println("即将爬取当前账号的收藏")
+			case "follow":
+				p.Strategy = strategy.Follow
+				log.Println("即将爬取关注用户的新作")
 			default:
-				p.CrawlStrategy = strategy.KeywordStrategy0
+				p.Strategy = strategy.Keyword
 				log.Println("即将根据搜索关键字爬取图片")
 			}
+		default:
+			// 未知参数
+			return false
 		}
 	}
 	return true
 }
 
-// 获取之前下载的缓存的函数, images/memos 缓存了曾经所有下载过的图片的id，以空格分隔
-func getOldImg(memo map[string]bool) {
-	os.MkdirAll("images", 0644)
-	memoFile, _ := os.OpenFile("images/memos",
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	reader := bufio.NewReader(memoFile)
-	for {
-		s, e := reader.ReadString(byte(' '))
-		if e != nil {
-			break
+// 将目录中的图片按数量分批转移到统一的文件夹
+func organize(args []string) int {
+	flags := flag.NewFlagSet("organize", flag.ContinueOnError)
+	src := flags.String("src", "", "源目录")
+	dst := flags.String("dst", "", "目标目录前缀, 按批次生成 <dst>0, <dst>1 ...")
+	batch := flags.Int("batch", 1000, "每个文件夹存放的图片数")
+	skip := flags.Int("skip", 0, "跳过源目录中的前N个文件")
+	move := flags.Bool("move", false, "转移完成后删除源文件")
+	flags.Usage = commandUsage(flags, "organize -src <源目录> -dst <目标目录> [参数]",
+		"将目录中的图片按数量分批转移到统一的文件夹")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
 		}
-		memo[strings.Split(s, " ")[0]] = true
+		return exitUsage
+	}
+	if len(*src) == 0 || len(*dst) == 0 || *batch < 1 {
+		flags.Usage()
+		return exitUsage
+	}
+	infos, err := ioutil.ReadDir(*src)
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+
+	// 文件转移线程池
+	fileChan := make(chan struct{}, 20)
+	waitGroup := sync.WaitGroup{}
+	var failed int32
+	for index, info := range infos {
+		if index < *skip || info.IsDir() {
+			continue
+		}
+		dstDir := *dst + strconv.Itoa(index / *batch)
+		if err := os.MkdirAll(dstDir, 0755); err != nil {
+			log.Println(err)
+			return exitError
+		}
+		fileChan <- struct{}{}
+		waitGroup.Add(1)
+		go func(dstFile, srcFile string) {
+			defer func() {
+				waitGroup.Done()
+				<-fileChan
+			}()
+			if err := copyFile(dstFile, srcFile); err != nil {
+				log.Println(srcFile, " 转移失败 ", err)
+				atomic.AddInt32(&failed, 1)
+				return
+			}
+			if *move {
+				os.Remove(srcFile)
+			}
+			log.Println(srcFile, " 转移完成！")
+		}(filepath.Join(dstDir, info.Name()), filepath.Join(*src, info.Name()))
 	}
-	memoFile.Close()
+	// 等待转移结束
+	waitGroup.Wait()
+	if failed > 0 {
+		log.Println(failed, " 个文件转移失败")
+		return exitError
+	}
+	return exitOK
 }
 
-func getCookie() string {
-	cookieFile, _ := os.OpenFile("cookie.txt",
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	reader := bufio.NewReader(cookieFile)
-	line, _, _ := reader.ReadLine()
-	cookie := fmt.Sprintf("%s", line)
-	return cookie[:len(cookie)-1]
+// 将目录中已下载的图片裁剪缩放为壁纸
+func wallpaper(config *pixiv.Config, args []string) int {
+	flags := flag.NewFlagSet("wallpaper", flag.ContinueOnError)
+	src := flags.String("src", config.ImageDir, "图片目录, 包含子目录")
+	dst := flags.String("dst", "", "壁纸目录, 默认 <src>/wallpapers")
+	targets := flags.String("targets", config.Wallpapers, "壁纸分辨率, 如 3840x2160,phone=1080x2400")
+	crop := flags.String("crop", config.WallpaperCrop, "裁剪方式 center: 居中 entropy: 信息熵最大 saliency: 边缘最多")
+	maxCrop := flags.Float64("max-crop", 0.4, "最多裁掉的面积比例, 超过时不生成该分辨率")
+	quality := flags.Int("quality", 92, "jpeg质量 1 - 100")
+	flags.Usage = commandUsage(flags, "wallpaper -targets <分辨率> [参数]",
+		"将已下载的图片裁剪缩放为各目标分辨率的壁纸, 已生成的跳过")
+	if err := flags.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK
+		}
+		return exitUsage
+	}
+	options, err := pixiv.ParseWallpaperOptions(*targets, *crop)
+	if err == nil && options == nil {
+		err = fmt.Errorf("缺少 -targets")
+	}
+	if err == nil {
+		options.MaxCrop, options.Quality = *maxCrop, *quality
+		err = options.Validate()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flags.Usage()
+		return exitUsage
+	}
+	if len(*dst) == 0 {
+		*dst = filepath.Join(*src, "wallpapers")
+	}
+
+	// 按CPU数并行处理
+	fileChan := make(chan struct{}, runtime.NumCPU())
+	waitGroup := sync.WaitGroup{}
+	var made, failed int32
+	err = filepath.Walk(*src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			// 跳过生成的壁纸和显示器链接
+			if path == *dst || (filepath.Dir(path) == filepath.Clean(*src) && info.Name() == "displays") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !pixiv.IsWallpaperSource(path) {
+			return nil
+		}
+		fileChan <- struct{}{}
+		waitGroup.Add(1)
+		go func() {
+			defer func() {
+				waitGroup.Done()
+				<-fileChan
+			}()
+			count, err := pixiv.MakeWallpapers(path, *dst, options)
+			atomic.AddInt32(&made, int32(count))
+			if err != nil {
+				log.Println(path, " 壁纸生成失败 ", err)
+				atomic.AddInt32(&failed, 1)
+			} else if count > 0 {
+				log.Println(path, " 生成 ", count, " 张壁纸")
+			}
+		}()
+		return nil
+	})
+	waitGroup.Wait()
+	log.Println("共生成 ", made, " 张壁纸")
+	if err != nil {
+		log.Println(err)
+		return exitError
+	}
+	if failed > 0 {
+		log.Println(failed, " 张图片处理失败")
+		return exitError
+	}
+	return exitOK
+}
+
+// 复制文件
+func copyFile(dst, src string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	dstFile, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		os.Remove(dst)
+		return err
+	}
+	return dstFile.Close()
+}
+
+// 读取Cookie文件中的账号并逐个检查, 没有可用账号时以未登录状态继续
+func loadAccounts(ctx context.Context, config *pixiv.Config, p *pixiv.Pixiv) {
+	pool, err := pixiv.LoadCookiePool(config.CookieFile)
+	if err != nil {
+		log.Println("Cookie读取失败, 以未登录状态爬取: ", err)
+		return
+	}
+	p.Accounts = pool
+	healthy := p.CheckAccounts(ctx)
+	log.Println("共 ", len(pool.Accounts()), " 个账号, ", healthy, " 个可用")
 }
@@ -0,0 +1,304 @@
+package pixiv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// 从Cookie的PHPSESSID中解析登录用户的ID, 格式为 <用户ID>_<随机串>
+func CookieUserId(cookie string) string {
+	for _, item := range strings.Split(cookie, ";") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 || kv[0] != "PHPSESSID" {
+			continue
+		}
+		if index := strings.Index(kv[1], "_"); index > 0 {
+			return kv[1][:index]
+		}
+	}
+	return ""
+}
+
+// 获取当前登录用户的ID, Cookie中没有时从pixiv返回的 x-userid 头中读取
+func (p *Pixiv) UserId(ctx context.Context) (string, error) {
+	return p.UserIdAs(ctx, p.UserCookie())
+}
+
+// 获取Cookie对应的用户ID
+func (p *Pixiv) UserIdAs(ctx context.Context, cookie string) (string, error) {
+	if userId := CookieUserId(cookie); len(userId) > 0 {
+		return userId, nil
+	}
+	if len(cookie) == 0 {
+		return "", errors.New("未登录, 请检查Cookie")
+	}
+	header := &http.Header{}
+	header.Add("user-agent", GetRandomUserAgent())
+	header.Add("cookie", cookie)
+	homeUrl, _ := url.Parse("https://www.pixiv.net/")
+	request := &http.Request{
+		Method: "GET",
+		URL:    homeUrl,
+		Header: *header,
+	}
+	resp, err := p.DoRequest(ctx, request)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if userId := resp.Header.Get("x-userid"); len(userId) > 0 {
+		return userId, nil
+	}
+	return "", errors.New("未登录, 请检查Cookie")
+}
+
+// 连续失败多少次后停用账号
+const accountMaxFailures = 3
+
+// 登录账号
+type Account struct {
+	Cookie string
+	// 健康检查时获取的用户ID, 用户名和是否为高级会员
+	UserId  string
+	Name    string
+	Premium bool
+	// 是否在轮换中
+	Healthy bool
+	// 停用原因
+	Reason string
+	// 连续失败次数
+	failures int
+}
+
+// 多账号Cookie池, 未指定Cookie的pixiv请求轮流使用可用的账号
+// 返回401的账号立即停用, 连续返回403或空的搜索结果 accountMaxFailures 次的账号停用
+type CookiePool struct {
+	mutex    sync.Mutex
+	accounts []*Account
+	next     int
+}
+
+// 创建Cookie池, 所有账号初始为可用
+func NewCookiePool(cookies []string) *CookiePool {
+	pool := &CookiePool{}
+	for _, cookie := range cookies {
+		pool.accounts = append(pool.accounts, &Account{Cookie: cookie, Healthy: true})
+	}
+	return pool
+}
+
+// 从文件读取Cookie, 每行一个账号, 忽略空行和 # 开头的注释
+func LoadCookiePool(name string) (*CookiePool, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var cookies []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		cookies = append(cookies, line)
+	}
+	if len(cookies) == 0 {
+		return nil, fmt.Errorf("%s 中没有Cookie", name)
+	}
+	return NewCookiePool(cookies), nil
+}
+
+// 所有账号的状态
+func (c *CookiePool) Accounts() []Account {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	accounts := make([]Account, len(c.accounts))
+	for i, account := range c.accounts {
+		accounts[i] = *account
+	}
+	return accounts
+}
+
+// 可用的账号数
+func (c *CookiePool) Healthy() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := 0
+	for _, account := range c.accounts {
+		if account.Healthy {
+			count++
+		}
+	}
+	return count
+}
+
+// 第一个可用账号的Cookie, 用于收藏、关注等与账号相关的请求, 没有可用账号时为空
+func (c *CookiePool) Primary() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, account := range c.accounts {
+		if account.Healthy {
+			return account.Cookie
+		}
+	}
+	return ""
+}
+
+// Cookie对应的账号是否可用, 不在账号池中的Cookie视为不可用
+func (c *CookiePool) IsHealthy(cookie string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, account := range c.accounts {
+		if account.Cookie == cookie {
+			return account.Healthy
+		}
+	}
+	return false
+}
+
+// 轮流选择可用的账号, 没有可用账号时返回空
+func (c *CookiePool) Next() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i := 0; i < len(c.accounts); i++ {
+		account := c.accounts[(c.next+i)%len(c.accounts)]
+		if account.Healthy {
+			c.next = (c.next + i + 1) % len(c.accounts)
+			return account.Cookie
+		}
+	}
+	return ""
+}
+
+// 记录账号的请求结果, permanent 为 true 时立即停用
+func (c *CookiePool) report(cookie string, ok, permanent bool, reason string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, account := range c.accounts {
+		if account.Cookie != cookie || !account.Healthy {
+			continue
+		}
+		if ok {
+			account.failures = 0
+			return
+		}
+		account.failures++
+		if permanent || account.failures >= accountMaxFailures {
+			account.Healthy = false
+			account.Reason = reason
+			log.Println("账号 ", account.label(), " 已停用: ", reason)
+		}
+		return
+	}
+}
+
+// 根据响应状态记录账号的请求结果
+// 搜索的响应要检查内容后才知道是否正常, 成功的状态码不在这里记录, 由调用处通过 ReportAccount 报告
+func (c *CookiePool) observe(resp *http.Response, site string) {
+	cookie := resp.Request.Header.Get("cookie")
+	if len(cookie) == 0 {
+		return
+	}
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		c.report(cookie, false, true, resp.Status)
+	case resp.StatusCode == http.StatusForbidden:
+		c.report(cookie, false, false, resp.Status)
+	case resp.StatusCode < 400 && site != RetrySearch:
+		c.report(cookie, true, false, "")
+	}
+}
+
+// 日志中显示的账号名称, 不显示Cookie
+func (a *Account) label() string {
+	if len(a.UserId) > 0 {
+		return a.UserId + "(" + a.Name + ")"
+	}
+	if userId := CookieUserId(a.Cookie); len(userId) > 0 {
+		return userId
+	}
+	return "未知"
+}
+
+// 报告响应内容是否正常, reason为空表示正常, 否则为异常原因(如搜索结果为空), 连续多次异常后停用该账号
+func (p *Pixiv) ReportAccount(resp *http.Response, reason string) {
+	if p.Accounts != nil && resp != nil && resp.Request != nil {
+		p.Accounts.report(resp.Request.Header.Get("cookie"), len(reason) == 0, false, reason)
+	}
+}
+
+// 请求使用的Cookie: 有账号池时轮流选择其中可用的账号, 否则使用 Cookie
+func (p *Pixiv) nextCookie() string {
+	if p.Accounts != nil {
+		return p.Accounts.Next()
+	}
+	return p.Cookie
+}
+
+// 收藏、关注等与账号相关的请求使用的Cookie: 有账号池时为第一个可用的账号, 停用后自动换到下一个, 否则使用 Cookie
+// 同一次爬取应在开始时取得并一直使用, 通过 AccountHealthy 确认账号没有被停用
+func (p *Pixiv) UserCookie() string {
+	if p.Accounts != nil {
+		return p.Accounts.Primary()
+	}
+	return p.Cookie
+}
+
+// Cookie对应的账号是否仍可用, 没有账号池时总是可用
+func (p *Pixiv) AccountHealthy(cookie string) bool {
+	return p.Accounts == nil || p.Accounts.IsHealthy(cookie)
+}
+
+// 检查所有账号: 确认已登录并获取用户ID和是否为高级会员, 不可用的账号停用, 返回可用的账号数
+func (p *Pixiv) CheckAccounts(ctx context.Context) int {
+	if p.Accounts == nil {
+		return 0
+	}
+	for _, account := range p.Accounts.accounts {
+		info, err := p.checkAccount(ctx, account.Cookie)
+		p.Accounts.mutex.Lock()
+		if err != nil {
+			account.Healthy = false
+			account.Reason = err.Error()
+			log.Println("账号 ", account.label(), " 不可用: ", err)
+		} else {
+			account.UserId, account.Name, account.Premium = info.UserId, info.Name, info.Premium
+			account.Healthy = true
+			log.Println("账号 ", account.label(), " 可用, 高级会员: ", account.Premium)
+		}
+		p.Accounts.mutex.Unlock()
+	}
+	return p.Accounts.Healthy()
+}
+
+// /ajax/user/<id> 返回的用户信息
+type userInfo struct {
+	UserId  string
+	Name    string
+	Premium bool
+}
+
+// 用指定的Cookie请求需要登录的接口, 并获取用户信息
+func (p *Pixiv) checkAccount(ctx context.Context, cookie string) (*userInfo, error) {
+	var extra json.RawMessage
+	if err := p.getAjaxAs(ctx, cookie, "https://www.pixiv.net/ajax/user/extra", "", &extra); err != nil {
+		return nil, fmt.Errorf("未登录: %v", err)
+	}
+	userId, err := p.UserIdAs(ctx, cookie)
+	if err != nil {
+		return nil, err
+	}
+	info := &userInfo{}
+	if err = p.getAjaxAs(ctx, cookie, "https://www.pixiv.net/ajax/user/"+userId+"?full=1", "", info); err != nil {
+		return nil, fmt.Errorf("用户信息获取失败: %v", err)
+	}
+	info.UserId = userId
+	return info, nil
+}
@@ -1,12 +1,19 @@
 package pixiv
 
 import (
-	"io"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -29,34 +36,95 @@ type Pixiv struct {
 	RequestPool   chan struct{}
 	CountDown     *sync.WaitGroup
 	Memo          map[string]bool
-	Done          chan bool
+	// 已下载作品的记录存储
+	Store *Store
+	// 图片保存的根目录, 默认 images
+	ImageDir string
 	// http请求代理客户端
 	Client *http.Client
-	// Cookie
+	// Cookie, 没有账号池时所有pixiv请求使用
 	Cookie string
+	// 多账号Cookie池, 不为空时pixiv请求轮流使用其中可用的账号, 收藏、关注等使用第一个可用的账号
+	Accounts *CookiePool
 	// 爬取关键字
 	KeyWord string
+	// 搜索时标签的匹配方式 s_tag_full: 完全一致 s_tag: 部分一致(默认) s_tc: 标题和说明文字
+	SearchMode string
 	// 要求点赞数 默认 1000
 	Bookmarks int
 	// 爬取的图片类型 W: 横屏 H: 竖屏 S: 小屏 O:其他(默认WH)
 	PicType string
+	// 筛选规则, 为空时根据 PicType, R18 和 Bookmarks 生成默认规则
+	Rules []Rule
+	// 目标显示器, 设置后只爬取适合其中至少一个显示器的作品, 并链接到各显示器的目录
+	Displays []Display
+	// 壁纸后处理, 不为空时将下载的图片裁剪缩放到各目标分辨率, 保存到 wallpapers/<名称>
+	Wallpaper *WallpaperOptions
 	// 重复图片下载概率 0 - 100
 	RepetitionOdds int
 	// 是否爬取r18
 	R18 bool
 	// 爬取时间终点
 	EndTime *time.Time
+	// 爬取时间起点, 目前只用于排行榜, 为空时只爬取终点当天
+	StartTime *time.Time
+	// 是否从上次中断的断点继续爬取
+	Resume bool
+	// 多图作品下载的页数 1: 只下载第一页(默认) 0: 下载全部 N: 最多下载N页
+	PageLimit int
+	// 动图合成格式 gif, apng 或两者(如 "gif,apng"), 为空只保存原始zip
+	UgoiraFormat string
 	// 负责向 PicChan 提供封装好的图片信息
-	CrawlStrategy func(p *Pixiv)
-	// 是否取消任务
-	IsCancel int32
+	Strategy Strategy
+	// 爬取过程中的事件回调
+	Events Events
+	// 请求的重试策略, 为空时使用 DefaultRetryPolicy
+	Retry *RetryPolicy
+	// 按域名限制请求速率, 为空时不限制
+	Limiter *RateLimiter
 	// 并发控制
 	Mutex *sync.Mutex
+	// 本次爬取中已获取的作品详情
+	infoCache *infoCache
+	infoMutex sync.Mutex
+	// 同时合成的动图数
+	ugoiraPool chan struct{}
+	// 同时生成壁纸的数量和正在生成的壁纸
+	wallpaperPool chan struct{}
+	wallpaperWait sync.WaitGroup
+	// 是否已经执行过 Run
+	ran int32
+}
+
+// 爬取策略: 发现作品, 筛选后通过 Submit 提交下载, ctx取消时应尽快返回
+// 无法开始爬取或有作品列表获取失败时返回错误, 由 Run 返回给调用方
+type Strategy interface {
+	Crawl(ctx context.Context, p *Pixiv) error
+}
+
+// 将函数适配为爬取策略
+type StrategyFunc func(ctx context.Context, p *Pixiv) error
+
+func (f StrategyFunc) Crawl(ctx context.Context, p *Pixiv) error {
+	return f(ctx, p)
+}
+
+// 事件回调, 未设置的回调会被忽略, 回调可能在多个协程中并发执行
+type Events struct {
+	// 策略发现了候选作品
+	Discovered func(illust *Illust)
+	// 候选作品未通过筛选, reason为原因
+	Filtered func(illust *Illust, reason string)
+	// 作品下载完成
+	Downloaded func(pic *PicDetail, elapsed time.Duration)
+	// 作品下载失败, 包括被中止的下载
+	Failed func(pic *PicDetail, err error)
 }
 
 // 存储爬取图片原始信息的结构体
 type UrlDetail struct {
-	Body struct {
+	Error bool
+	Body  struct {
 		Illust struct {
 			Data  []Illust
 			Total int
@@ -70,113 +138,296 @@ type UrlDetail2 struct {
 	}
 }
 
+// 作者信息
+type UserDetail struct {
+	Body struct {
+		UserId string
+		Name   string
+	}
+}
+
+// 作者所有作品的ID
+type ProfileAll struct {
+	Body struct {
+		Illusts WorkIds
+		Manga   WorkIds
+	}
+}
+
+// 作品ID集合, 作品为空时pixiv返回的是空数组而不是对象
+type WorkIds json.RawMessage
+
+func (w *WorkIds) UnmarshalJSON(data []byte) error {
+	*w = append((*w)[0:0], data...)
+	return nil
+}
+
+// 解析出所有作品ID, 按ID从大到小(由新到旧)排序
+func (w WorkIds) Ids() []string {
+	works := make(map[string]interface{})
+	if err := json.Unmarshal(w, &works); err != nil {
+		return nil
+	}
+	ids := make([]string, 0, len(works))
+	for id := range works {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if len(ids[i]) != len(ids[j]) {
+			return len(ids[i]) > len(ids[j])
+		}
+		return ids[i] > ids[j]
+	})
+	return ids
+}
+
+// 作者作品的详细信息
+type ProfileWorks struct {
+	Body struct {
+		Works map[string]Illust
+	}
+}
+
 // 图片原始信息
 type Illust struct {
-	Id   string
-	Type string
+	Id    string
+	Type  string
+	Title string
+	// 作者
+	UserId, UserName string
 	// 图片地址
 	Url  string
 	Tags []string
 	// 创建时间
 	CreateDate string
-	// 图片宽度，高度，收藏数
-	Width, Height, BookmarkData int
+	// 图片宽度，高度，页数
+	Width, Height, PageCount int
+	// 收藏数, 接口中的bookmarkData是当前用户的收藏信息, 不解析
+	BookmarkData int `json:"-"`
+	// 作品类型 0: 插画 1: 漫画 2: 动图
+	IllustType int
 }
 
 // 爬取图片的具体信息
 type PicDetail struct {
-	Id  string
-	Url string
+	Id    string
+	Url   string
+	Title string
+	// 作者
+	UserId, UserName string
+	Tags             []string
+	// 图片宽度，高度，收藏数
+	Width, Height, Bookmarks int
 	// 宽高比
 	Ratio float32
 	// 图片类型，横屏，竖屏（直接对应存储的文件名）
 	Group string
+	// 作品页数
+	PageCount int
+	// 作品类型 0: 插画 1: 漫画 2: 动图
+	IllustType int
+	// 适合的显示器名称
+	Displays []string
+	// 原图地址的来源 pages 或 guess
+	UrlSource string
+	// 下载完成的本地文件
+	Files []StoredFile
+}
+
+// 生成作品的存储记录
+func (d *PicDetail) Record() *Record {
+	return &Record{
+		Id:           d.Id,
+		Title:        d.Title,
+		UserId:       d.UserId,
+		UserName:     d.UserName,
+		Tags:         d.Tags,
+		Width:        d.Width,
+		Height:       d.Height,
+		Bookmarks:    d.Bookmarks,
+		PageCount:    d.PageCount,
+		UrlSource:    d.UrlSource,
+		Files:        d.Files,
+		DownloadTime: time.Now(),
+	}
+}
+
+// 记录下载完成的本地文件及其下载地址
+func (d *PicDetail) addFile(name, fileUrl string) {
+	file, err := checksumFile(name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	file.Url = fileUrl
+	d.Files = append(d.Files, file)
 }
 
-// 向文件写入缓存的任务通道
-var cacheChan = make(chan string, 20)
+// 执行爬取任务: 策略负责发现作品并在结束时关闭 PicChan, 同时分发下载任务
+// ctx取消后停止发现新作品并中止正在进行的下载, 所有下载结束后才返回
+// 返回ctx的错误或策略的错误; 结束时 PicChan 和记录存储都已关闭, 每个 Pixiv 只能 Run 一次
+func (p *Pixiv) Run(ctx context.Context) error {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-// 分发下载任务
-func (p *Pixiv) CrawUrl() {
+	if p.Strategy == nil {
+		return errors.New("未设置爬取策略")
+	}
+	if !atomic.CompareAndSwapInt32(&p.ran, 0, 1) {
+		return errors.New("Run 只能调用一次, 请使用 New 创建新的 Pixiv")
+	}
+	// 直接构造的 Pixiv 没有初始化内部的并发控制
+	if p.ugoiraPool == nil {
+		p.ugoiraPool = make(chan struct{}, ugoiraConcurrency)
+	}
+	if p.wallpaperPool == nil {
+		p.wallpaperPool = make(chan struct{}, runtime.NumCPU())
+	}
+	// 加载已下载作品的记录，防止下载之前的重复图片
+	if p.Store == nil {
+		store, err := OpenStore(p.RootDir())
+		if err != nil {
+			return fmt.Errorf("记录存储打开失败: %v", err)
+		}
+		p.Store = store
+	}
+	p.Mutex.Lock()
+	for _, id := range p.Store.Ids() {
+		p.Memo[id] = true
+	}
+	p.Mutex.Unlock()
+	p.resetInfoCache()
+	if linked := p.linkStoredDisplays(); linked > 0 {
+		log.Println("已下载的作品中 ", linked, " 张适合目标显示器, 已链接到显示器目录")
+	}
+	if parts := p.countParts(); parts > 0 {
+		log.Println("发现 ", parts, " 个未完成的下载, 再次爬取到这些作品时将继续下载")
+	}
 
-	var index int64 = 1
-	// 开启缓存任务
-	go addCache()
+	// 把keyword转成浏览器可用16进制
+	p.KeyWord = url.QueryEscape(p.KeyWord)
+	strategyDone := make(chan struct{})
+	var strategyErr error
+	go func() {
+		defer close(strategyDone)
+		defer close(p.PicChan)
+		strategyErr = p.Strategy.Crawl(ctx, p)
+	}()
+
+	p.crawUrl(ctx)
+	// 等待已经启动的下载和壁纸结束, 再通知策略停止并等待其返回
+	p.CountDown.Wait()
+	p.wallpaperWait.Wait()
+	cancel()
+	<-strategyDone
 
-	var numAll int64 = 0
-	var numDown int64 = 0
+	// 压缩并关闭记录存储
+	if err := p.Store.Compact(); err != nil {
+		log.Println("记录压缩失败 ", err)
+	}
+	p.Store.Close()
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	return strategyErr
+}
+
+// 分发下载任务, 直到 PicChan 关闭或ctx取消
+func (p *Pixiv) crawUrl(ctx context.Context) {
+	var index int64 = 1
 	// 从图片ID通道读取图片ID并开启一个协程下载
-	for pic := range p.PicChan {
-		// 判断是否取消任务
-		if p.Cancelled() {
-			// 标记取消任务
-			atomic.AddInt32(&p.IsCancel, 1)
-			break
+	for {
+		var pic *PicDetail
+		select {
+		case <-ctx.Done():
+			return
+		case detail, ok := <-p.PicChan:
+			if !ok {
+				return
+			}
+			pic = detail
 		}
 		imgId := pic.Id
-		numAll++
-		//if numAll%100 == 0 {
-		//	log.Println("下载率(", len(p.Memo), "):", 100*float64(numDown)/float64(numAll), "%")
-		//}
-		// 判断是否下载过all
+		// 判断是否下载过
 		p.Mutex.Lock()
-		if p.RepetitionDownload(imgId) {
-			p.Memo[imgId] = true
+		if !p.RepetitionDownload(imgId) {
 			p.Mutex.Unlock()
-			numDown++
-			// 从池中申请一个协程，开启任务
-			p.GoroutinePool <- struct{}{}
-			// 任务计数加一
-			p.CountDown.Add(1)
-			go func(detail *PicDetail) {
-				start := time.Now()
-				// 根据ID下载图片, isDown代表下载成功或者失败
-				isDown := p.downloadImg(detail)
-				// 如果下载成功则通知缓存通道向memos中添加已经下载图片的ID
-				// 然后通知用户图片下载成功以及用时
-				if isDown {
-					// 通知缓存队列
-					cacheChan <- detail.Id
-					log.Println(index, ": ", detail.Id, " 爬取成功 !",
-						time.Since(start), " 输入 q 退出...")
-					// 使用原子递增保证线程安全
-					atomic.AddInt64(&index, 1)
+			continue
+		}
+		p.Memo[imgId] = true
+		p.Mutex.Unlock()
+		// 从池中申请一个协程，开启任务
+		select {
+		case p.GoroutinePool <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		// 任务计数加一
+		p.CountDown.Add(1)
+		go func(detail *PicDetail) {
+			start := time.Now()
+			// 根据ID下载图片
+			err := p.downloadImg(ctx, detail)
+			// 如果下载成功则将作品记录写入存储
+			// 然后通知用户图片下载成功以及用时
+			if err == nil {
+				p.linkDisplays(detail)
+				p.makeWallpapers(ctx, detail)
+				if err := p.Store.Put(detail.Record()); err != nil {
+					log.Println(detail.Id, " 记录写入失败 ", err)
+				}
+				log.Println(atomic.AddInt64(&index, 1)-1, ": ", detail.Id, " 爬取成功 !",
+					time.Since(start), " 输入 q 退出...")
+				if p.Events.Downloaded != nil {
+					p.Events.Downloaded(detail, time.Since(start))
+				}
+			} else {
+				if ctx.Err() != nil {
+					log.Println(detail.Id, " 下载已中止")
 				} else {
-					log.Println(detail.Id, " 爬取失败 !")
+					log.Println(detail.Id, " 爬取失败 !", err)
 				}
-				// 正在运行任务数减一，并向池中归还协程
-				p.CountDown.Done()
-				<-p.GoroutinePool
-			}(pic)
-		} else {
-			p.Mutex.Unlock()
-		}
+				if p.Events.Failed != nil {
+					p.Events.Failed(detail, err)
+				}
+			}
+			// 正在运行任务数减一，并向池中归还协程
+			p.CountDown.Done()
+			<-p.GoroutinePool
+		}(pic)
 	}
-	// 关闭线程池
-	close(p.GoroutinePool)
-	close(p.RequestPool)
-	// 等待任务全部完成,关闭缓存队列
-	p.CountDown.Wait()
-	close(cacheChan)
-	// 整理memos文件
-	settleCache(p)
-	close(p.Done)
 }
 
-// 根据输入关键字获取图片id
-func (p *Pixiv) GetUrls() {
+// 向下载通道提交作品, ctx取消时放弃并返回false
+func (p *Pixiv) Submit(ctx context.Context, pic *PicDetail) bool {
+	select {
+	case p.PicChan <- pic:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	// 把keyword转成浏览器可用16进制
-	p.KeyWord = url.QueryEscape(p.KeyWord)
-	go func() {
-		p.CrawlStrategy(p)
-		// 优雅关闭
-		if atomic.LoadInt32(&p.IsCancel) == 0 {
-			p.PicChan <- &PicDetail{}
-			p.Done <- true
-			p.PicChan <- &PicDetail{}
-		}
-	}()
+// 作品是否已经下载过或已提交下载, 可并发调用
+func (p *Pixiv) IsDownloaded(imgId string) bool {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	return p.Memo[imgId]
+}
+
+// 通知策略发现了候选作品
+func (p *Pixiv) EmitDiscovered(illust *Illust) {
+	if p.Events.Discovered != nil {
+		p.Events.Discovered(illust)
+	}
+}
+
+// 通知候选作品未通过筛选
+func (p *Pixiv) EmitFiltered(illust *Illust, reason string) {
+	if p.Events.Filtered != nil {
+		p.Events.Filtered(illust, reason)
+	}
 }
 
 // 判断是否重复下载
@@ -185,119 +436,227 @@ func (p *Pixiv) RepetitionDownload(imgId string) bool {
 	return !p.Memo[imgId] || (p.RepetitionOdds > 0 && rand.Intn(100) < p.RepetitionOdds)
 }
 
-// 根据传入图片Id下载图片
-func (p *Pixiv) downloadImg(detail *PicDetail) bool {
-	referUrl := referUrl + detail.Id
+// 根据传入图片Id下载图片, 多图作品需要所有页下载成功才算成功
+// 原图地址从作品页面接口获取, 获取失败时才根据缩略图地址猜测
+func (p *Pixiv) downloadImg(ctx context.Context, detail *PicDetail) error {
+	// 动图单独处理
+	if detail.IllustType == UgoiraType {
+		return p.downloadUgoira(ctx, detail)
+	}
+	illustPages, err := p.IllustPages(ctx, detail.Id)
+	if err != nil || len(illustPages) == 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Println(detail.Id, " 原图地址获取失败, 根据缩略图地址猜测 ", err)
+		return p.guessImg(ctx, detail)
+	}
+	detail.UrlSource = UrlFromPages
+	detail.PageCount = len(illustPages)
+	pages := p.pages(detail)
+	for page := 0; page < pages; page++ {
+		original := illustPages[page].Urls.Original
+		picName := pageName(detail.Id, page, pages, path.Ext(original))
+		err := p.downloadPage(ctx, detail, original, picName, illustPages[page].Width, illustPages[page].Height)
+		if err == errNotFound {
+			return fmt.Errorf("%s 下载失败: %v", original, err)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 原图地址的来源
+const (
+	// 作品页面接口 /ajax/illust/<id>/pages
+	UrlFromPages = "pages"
+	// 根据缩略图地址猜测
+	UrlGuessed = "guess"
+)
+
+// 猜测原图地址时依次尝试的扩展名
+var guessTypes = []string{"jpg", "png", "gif"}
 
-	// 拼接图片地址URL
+// 根据缩略图地址拼接原图地址, 依次尝试 guessTypes 中的扩展名
+func (p *Pixiv) guessImg(ctx context.Context, detail *PicDetail) error {
 	originalUrl := detail.Url
-	if len(originalUrl) == 0 {
-		return false
+	if len(originalUrl) == 0 || !strings.Contains(originalUrl, "/img/") {
+		return fmt.Errorf("图片地址无效: %q", originalUrl)
 	}
 	secondUrl := strings.Split(originalUrl, "/img/")[1]
 	imgDateId := strings.Split(secondUrl, "_")[0]
-	imgType := strings.Split(secondUrl, ".")[1]
-	endUrl := baseUrl + imgDateId + "_p0." + imgType
-
-	pictureUrl := &url.URL{}
-	pictureUrl, _ = pictureUrl.Parse(endUrl)
 
-	// 设置http请求地址，如果不设置referer，将返回403页面
-	header := &http.Header{}
-	header.Add("referer", referUrl)
-	header.Add("user-agent", GetRandomUserAgent())
+	detail.UrlSource = UrlGuessed
+	pages := p.pages(detail)
+	for page := 0; page < pages; page++ {
+		// 作品信息中的尺寸为第一页的尺寸
+		width, height := 0, 0
+		if page == 0 {
+			width, height = detail.Width, detail.Height
+		}
+		err := errNotFound
+		endUrl := ""
+		for _, imgType := range guessTypes {
+			endUrl = baseUrl + imgDateId + "_p" + strconv.Itoa(page) + "." + imgType
+			picName := pageName(detail.Id, page, pages, "."+imgType)
+			if err = p.downloadPage(ctx, detail, endUrl, picName, width, height); err != errNotFound {
+				break
+			}
+		}
+		if err == errNotFound {
+			return fmt.Errorf("%s 下载失败: 尝试 %s 均不存在", detail.Id, strings.Join(guessTypes, ", "))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	request := &http.Request{
-		Method: "GET",
-		URL:    pictureUrl,
-		Header: *header,
+// 根据PageLimit计算作品需要下载的页数
+func (p *Pixiv) pages(detail *PicDetail) int {
+	pages := detail.PageCount
+	if pages < 1 {
+		pages = 1
 	}
-	// 下载图片
-	client := p.Client
-	resp, err := client.Do(request)
-	if err != nil {
-		return false
+	if p.PageLimit > 0 && pages > p.PageLimit {
+		pages = p.PageLimit
 	}
-	defer resp.Body.Close()
+	return pages
+}
 
-	picName := detail.Id + "." + imgType
+// 作品某一页的文件名: 只下载一页时为 <id>.ext, 否则为 <id>_p<页码>.ext
+func pageName(id string, page, pages int, ext string) string {
+	if pages > 1 {
+		return id + "_p" + strconv.Itoa(page) + ext
+	}
+	return id + ext
+}
 
+// 第一页的另一种文件名, 修改 PageLimit 前后第一页的文件名不同; 不是第一页时返回空
+func alternateName(id, picName string) string {
+	ext := path.Ext(picName)
+	switch picName {
+	case id + ext:
+		return id + "_p0" + ext
+	case id + "_p0" + ext:
+		return id + ext
+	}
+	return ""
+}
+
+// 下载作品的某一页并记录, 文件不存在时返回 errNotFound
+// width和height大于0时校验图片尺寸
+func (p *Pixiv) downloadPage(ctx context.Context, detail *PicDetail, fileUrl, picName string, width, height int) error {
 	// 根据图片的尺寸信息确定图片归属
-	bathPath := "images/" + detail.Group + "/"
+	bathPath := p.GroupDir(detail.Group)
 	// 创建图片目录
-	os.MkdirAll(bathPath, 0644)
-	file, e := os.OpenFile(bathPath+picName, os.O_RDWR|os.O_CREATE, 0644)
-	if e != nil {
-		log.Println(err)
-		return false
+	if err := os.MkdirAll(bathPath, 0755); err != nil {
+		return err
 	}
-	defer file.Close()
-	// 将图片下载的流直接对接到相应文件
-	_, err = io.Copy(file, resp.Body)
-	if err != nil {
-		log.Println(err)
-		file.Close()
-		os.Remove(bathPath + picName)
-		return false
+	// 第一页已经以另一种文件名下载过时直接使用, 不再重复下载
+	if alt := alternateName(detail.Id, picName); len(alt) > 0 {
+		if _, err := os.Stat(bathPath + alt); err == nil {
+			detail.addFile(bathPath+alt, fileUrl)
+			return nil
+		}
+	}
+	imgType := strings.TrimPrefix(path.Ext(picName), ".")
+	err := p.download(ctx, &download{
+		Url:          fileUrl,
+		Referer:      referUrl + detail.Id,
+		Path:         bathPath + picName,
+		ContentTypes: []string{"image/"},
+		Verify: func(name string) error {
+			return verifyImage(name, imgType, width, height)
+		},
+	})
+	if err == errNotFound {
+		return err
 	}
-	// 如果下载出现问题则删除文件
-	info, err := file.Stat()
 	if err != nil {
-		log.Println(err)
-		file.Close()
-		os.Remove(bathPath + picName)
-		return false
+		return fmt.Errorf("%s 下载失败: %v", fileUrl, err)
 	}
-	if info.Size() < 100 {
-		if strings.Contains(originalUrl, "png") {
-			log.Println("文件下载失败! ", endUrl)
-		}
-		file.Close()
-		os.Remove(bathPath + picName)
-		detail.Url = originalUrl[:len(originalUrl)-3] + "png"
-		return p.downloadImg(detail)
+	detail.addFile(bathPath+picName, fileUrl)
+	return nil
+}
+
+// 图片保存的根目录
+func (p *Pixiv) RootDir() string {
+	if len(p.ImageDir) == 0 {
+		return "images"
 	}
-	return true
+	return strings.TrimSuffix(p.ImageDir, "/")
 }
 
-// http请求 进行并发度控制
-func (p *Pixiv) DoRequest(req *http.Request) (*http.Response, error) {
-	p.RequestPool <- struct{}{}
-	response, e := p.Client.Do(req)
-	<-p.RequestPool
-	return response, e
+// 分组对应的保存目录, 以 / 结尾
+func (p *Pixiv) GroupDir(group string) string {
+	return p.RootDir() + "/" + group + "/"
 }
 
-// 向缓存文件写入新下载的文件
-func addCache() {
-	file, _ := os.OpenFile("images/memos",
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	for imgId := range cacheChan {
-		file.WriteString(imgId + " ")
-	}
-	file.Close()
+// http请求 进行并发度控制并按重试策略重试, ctx取消时放弃等待并中止请求
+func (p *Pixiv) DoRequest(ctx context.Context, req *http.Request) (*http.Response, error) {
+	return p.DoRequestRetry(ctx, req, RetryDefault)
+}
+
+// 同 DoRequest, 使用调用处site的重试次数
+func (p *Pixiv) DoRequestRetry(ctx context.Context, req *http.Request, site string) (*http.Response, error) {
+	return p.retry(ctx, site, func() (*http.Response, error) {
+		// 等待重试和限速时不占用并发数
+		if p.Limiter != nil {
+			if err := p.Limiter.Wait(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case p.RequestPool <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// 每次重试重新选择账号
+		attempt := p.withCookie(ctx, req)
+		response, e := p.Client.Do(attempt)
+		<-p.RequestPool
+		if e == nil && p.Limiter != nil {
+			p.Limiter.Observe(attempt, response)
+		}
+		if e == nil && p.Accounts != nil {
+			p.Accounts.observe(response, site)
+		}
+		return response, e
+	})
 }
 
-// 整理缓存文件
-func settleCache(p *Pixiv) {
-	tmpFile, _ := os.OpenFile("images/tmp",
-		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
-	for id := range p.Memo {
-		tmpFile.WriteString(id + " ")
+// 没有指定Cookie的pixiv请求加上账号池中轮流选择的Cookie
+func (p *Pixiv) withCookie(ctx context.Context, req *http.Request) *http.Request {
+	host := strings.ToLower(req.URL.Hostname())
+	if len(req.Header.Get("cookie")) > 0 || (host != "pixiv.net" && !strings.HasSuffix(host, ".pixiv.net")) {
+		return req.WithContext(ctx)
 	}
-	tmpFile.Close()
-	os.Remove("images/memos")
-	os.Rename("images/tmp", "images/memos")
+	cookie := p.nextCookie()
+	if len(cookie) == 0 {
+		return req.WithContext(ctx)
+	}
+	clone := req.Clone(ctx)
+	clone.Header.Set("cookie", cookie)
+	return clone
 }
 
-// 判断任务是否结束
-func (p *Pixiv) Cancelled() bool {
-	select {
-	case <-p.Done:
-		return true
-	default:
-		return false
+// 按域名限速后发送请求, 并根据响应调整速率
+func (p *Pixiv) send(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if p.Limiter == nil {
+		return p.Client.Do(req.WithContext(ctx))
+	}
+	if err := p.Limiter.Wait(ctx, req); err != nil {
+		return nil, err
+	}
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err == nil {
+		p.Limiter.Observe(req, resp)
 	}
+	return resp, err
 }
 
 func GetRandomUserAgent() string {
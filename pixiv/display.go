@@ -0,0 +1,171 @@
+package pixiv
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 默认的宽高比容差
+const DefaultDisplayTolerance = 0.05
+
+// 显示器目录, 位于图片根目录下
+const displayDir = "displays"
+
+// 目标显示器
+type Display struct {
+	// 目录名, 默认为分辨率
+	Name          string
+	Width, Height int
+	// 宽高比的相对容差, 如 0.05 表示相差不超过5%
+	Tolerance float64
+}
+
+// 解析以逗号分隔的显示器列表, 格式为 [名称=]宽x高[@容差], 如 3840x2160,phone=1080x2400@0.1
+// 未指定容差时使用tolerance
+func ParseDisplays(s string, tolerance float64) ([]Display, error) {
+	if tolerance < 0 {
+		return nil, fmt.Errorf("显示器容差不能小于0: %v", tolerance)
+	}
+	var displays []Display
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		display := Display{Tolerance: tolerance}
+		if index := strings.Index(item, "="); index >= 0 {
+			display.Name = item[:index]
+			item = item[index+1:]
+		}
+		if index := strings.Index(item, "@"); index >= 0 {
+			value, err := strconv.ParseFloat(item[index+1:], 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("显示器容差格式错误: %s", item)
+			}
+			display.Tolerance = value
+			item = item[:index]
+		}
+		size := strings.Split(strings.ToLower(item), "x")
+		if len(size) != 2 {
+			return nil, fmt.Errorf("显示器分辨率格式错误: %s", item)
+		}
+		var err error
+		if display.Width, err = strconv.Atoi(size[0]); err != nil || display.Width <= 0 {
+			return nil, fmt.Errorf("显示器宽度格式错误: %s", item)
+		}
+		if display.Height, err = strconv.Atoi(size[1]); err != nil || display.Height <= 0 {
+			return nil, fmt.Errorf("显示器高度格式错误: %s", item)
+		}
+		if len(display.Name) == 0 {
+			display.Name = item
+		}
+		if !validDirName(display.Name) {
+			return nil, fmt.Errorf("显示器名称不能用作目录名: %q", display.Name)
+		}
+		displays = append(displays, display)
+	}
+	return displays, nil
+}
+
+// 名称能否直接用作目录名: 不能包含路径分隔符、控制字符和 windows 下不能用于文件名的字符,
+// 首尾不能是空格或点, 因此也排除了 . 和 ..
+func validDirName(name string) bool {
+	if len(name) == 0 || strings.Trim(name, " .") != name {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r)
+	}) < 0
+}
+
+// 作品是否适合该显示器: 宽高比在容差内, 且分辨率不低于显示器
+func (d *Display) Fits(width, height int) bool {
+	if width < d.Width || height < d.Height {
+		return false
+	}
+	target := float64(d.Width) / float64(d.Height)
+	ratio := float64(width) / float64(height)
+	return math.Abs(ratio-target)/target <= d.Tolerance
+}
+
+// 作品适合的所有显示器
+func (p *Pixiv) MatchDisplays(width, height int) []string {
+	var names []string
+	for i := range p.Displays {
+		if p.Displays[i].Fits(width, height) {
+			names = append(names, p.Displays[i].Name)
+		}
+	}
+	return names
+}
+
+// 显示器目录
+func (p *Pixiv) DisplayDir(name string) string {
+	return filepath.Join(p.RootDir(), displayDir, name)
+}
+
+// 将下载完成的图片链接到适合的显示器目录, 动图只链接合成后的图片
+func (p *Pixiv) linkDisplays(detail *PicDetail) {
+	p.linkFiles(detail.Id, detail.Displays, detail.Files)
+}
+
+// 将已下载的作品链接到适合的显示器目录, 用于新增显示器后补齐之前下载的作品, 返回适合的作品数
+// 旧版本迁移的记录没有尺寸, 不处理
+func (p *Pixiv) linkStoredDisplays() int {
+	if len(p.Displays) == 0 {
+		return 0
+	}
+	count := 0
+	for _, id := range p.Store.Ids() {
+		record, ok := p.Store.Get(id)
+		if !ok || record.Width <= 0 || record.Height <= 0 {
+			continue
+		}
+		if names := p.MatchDisplays(record.Width, record.Height); len(names) > 0 {
+			p.linkFiles(id, names, record.Files)
+			count++
+		}
+	}
+	return count
+}
+
+// 将作品的文件链接到各显示器目录, 已存在的链接跳过
+func (p *Pixiv) linkFiles(id string, names []string, files []StoredFile) {
+	for _, name := range names {
+		dir := p.DisplayDir(name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Println(id, " 显示器目录创建失败 ", err)
+			return
+		}
+		for _, file := range files {
+			path := filepath.FromSlash(file.Path)
+			switch filepath.Ext(path) {
+			case ".zip", ".json":
+				continue
+			}
+			if err := linkFile(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+				log.Println(id, " 链接到显示器 ", name, " 失败 ", err)
+			}
+		}
+	}
+}
+
+// 创建硬链接, 不支持时(如跨分区)改为符号链接, 已存在时跳过
+func linkFile(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return nil
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	abs, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(abs, dst)
+}
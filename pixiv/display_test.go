@@ -0,0 +1,85 @@
+package pixiv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDisplays(t *testing.T) {
+	tests := []struct {
+		input    string
+		displays []Display
+		ok       bool
+	}{
+		{"", nil, true},
+		{"3840x2160", []Display{{Name: "3840x2160", Width: 3840, Height: 2160, Tolerance: 0.05}}, true},
+		{" 3840X2160 , phone=1080x2400@0.1", []Display{
+			{Name: "3840X2160", Width: 3840, Height: 2160, Tolerance: 0.05},
+			{Name: "phone", Width: 1080, Height: 2400, Tolerance: 0.1},
+		}, true},
+		{"1920x1080@0", []Display{{Name: "1920x1080", Width: 1920, Height: 1080}}, true},
+		{"3840", nil, false},
+		{"0x2160", nil, false},
+		{"3840x-1", nil, false},
+		{"3840x2160@-1", nil, false},
+		{"3840x2160@abc", nil, false},
+		{"a/b=3840x2160", nil, false},
+		{`a\b=3840x2160`, nil, false},
+		{"..=3840x2160", nil, false},
+		{".=3840x2160", nil, false},
+		{"=3840x2160", []Display{{Name: "3840x2160", Width: 3840, Height: 2160, Tolerance: 0.05}}, true},
+		{"a:b=3840x2160", nil, false},
+		{" a=3840x2160", []Display{{Name: "a", Width: 3840, Height: 2160, Tolerance: 0.05}}, true},
+		{"a =3840x2160", nil, false},
+	}
+	for _, test := range tests {
+		displays, err := ParseDisplays(test.input, DefaultDisplayTolerance)
+		if (err == nil) != test.ok {
+			t.Errorf("ParseDisplays(%q) error = %v, want ok %v", test.input, err, test.ok)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(displays, test.displays) {
+			t.Errorf("ParseDisplays(%q) = %+v, want %+v", test.input, displays, test.displays)
+		}
+	}
+	if _, err := ParseDisplays("3840x2160", -1); err == nil {
+		t.Errorf("负的容差没有返回错误")
+	}
+}
+
+func TestDisplayFits(t *testing.T) {
+	display := Display{Width: 1920, Height: 1080, Tolerance: 0.05}
+	tests := []struct {
+		width, height int
+		fits          bool
+	}{
+		{1920, 1080, true},
+		{3840, 2160, true},
+		{2000, 1080, true},
+		{2100, 1080, false},
+		{1920, 1000, false},
+		{1800, 1013, false},
+		{1080, 1920, false},
+	}
+	for _, test := range tests {
+		if fits := display.Fits(test.width, test.height); fits != test.fits {
+			t.Errorf("Fits(%d, %d) = %v, want %v", test.width, test.height, fits, test.fits)
+		}
+	}
+
+	p := &Pixiv{Displays: []Display{display, {Name: "phone", Width: 1080, Height: 2400, Tolerance: 0.1}}}
+	p.Displays[0].Name = "desktop"
+	matches := []struct {
+		width, height int
+		names         []string
+	}{
+		{3840, 2160, []string{"desktop"}},
+		{1440, 3200, []string{"phone"}},
+		{1000, 1000, nil},
+	}
+	for _, test := range matches {
+		if names := p.MatchDisplays(test.width, test.height); !reflect.DeepEqual(names, test.names) {
+			t.Errorf("MatchDisplays(%d, %d) = %v, want %v", test.width, test.height, names, test.names)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package pixiv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 未完成下载的临时文件后缀
+const partSuffix = ".part"
+
+// 文件不存在, 原图扩展名不对时返回
+var errNotFound = errors.New("文件不存在")
+
+// 文件下载任务
+type download struct {
+	Url     string
+	Referer string
+	// 保存路径, 下载过程中写入 Path + ".part"
+	Path string
+	// 允许的Content-Type前缀, 为空时不检查
+	ContentTypes []string
+	// 重命名前校验下载完成的临时文件
+	Verify func(name string) error
+}
+
+// 未完成下载的信息, 保存在 .part.json, 下次运行时据此断点续传
+type partInfo struct {
+	Url string
+	// 用于 If-Range 确认服务器上的文件没有变化
+	ETag, LastModified string
+	// 文件总大小, 未知时为 -1
+	Size int64
+}
+
+// 续传时的 If-Range, 弱ETag不能用于范围请求
+func (i *partInfo) validator() string {
+	if len(i.ETag) > 0 && !strings.HasPrefix(i.ETag, "W/") {
+		return i.ETag
+	}
+	return i.LastModified
+}
+
+// 下载文件: 先写入 .part 临时文件, 校验长度、类型和内容后再重命名到目标路径
+// 连接失败、429/5xx和传输中断都按同一个重试策略重试, 已下载的部分保留, 从该位置继续, 下次运行时同样继续
+// 内容校验失败时删除临时文件
+func (p *Pixiv) download(ctx context.Context, d *download) error {
+	policy := p.retryPolicy()
+	forbidden := 0
+	for attempt := 1; ; attempt++ {
+		retry, wait, err := p.downloadPart(ctx, d, policy, &forbidden)
+		if err == nil || !retry || ctx.Err() != nil {
+			return err
+		}
+		if attempt > policy.Budget(RetryDownload) ||
+			!p.waitRetry(ctx, RetryDownload, attempt, d.Url+" "+err.Error(), wait) {
+			return err
+		}
+	}
+}
+
+// 下载一次, 已有临时文件时从末尾继续, 返回失败后是否可以重试以及最短的等待时间
+// forbidden 为已经重试过的403次数
+func (p *Pixiv) downloadPart(ctx context.Context, d *download, policy *RetryPolicy, forbidden *int) (bool, time.Duration, error) {
+	part := d.Path + partSuffix
+	offset := int64(0)
+	info := &partInfo{}
+	if stat, err := os.Stat(part); err == nil && readPartInfo(part, info) == nil &&
+		info.Url == d.Url && len(info.validator()) > 0 {
+		offset = stat.Size()
+	}
+
+	request, err := http.NewRequest("GET", d.Url, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	// 如果不设置referer，将返回403页面
+	request.Header.Set("referer", d.Referer)
+	request.Header.Set("user-agent", GetRandomUserAgent())
+	if offset > 0 {
+		// 文件有变化时服务器返回完整的文件
+		request.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		request.Header.Set("If-Range", info.validator())
+	}
+	resp, err := p.send(ctx, request)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	if reason, wait, ok := policy.retryable(resp, *forbidden); ok {
+		if resp.StatusCode == http.StatusForbidden {
+			*forbidden++
+		}
+		return true, wait, errors.New(reason)
+	}
+
+	total := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			removePart(part)
+			return true, 0, fmt.Errorf("续传位置不符合: %s", resp.Header.Get("Content-Range"))
+		}
+		total = size
+	case http.StatusRequestedRangeNotSatisfiable:
+		removePart(part)
+		return true, 0, errors.New("续传范围无效, 重新下载")
+	case http.StatusNotFound:
+		return false, 0, errNotFound
+	default:
+		return false, 0, fmt.Errorf("%s 下载失败: %s", d.Url, resp.Status)
+	}
+	if err = checkContentType(resp.Header.Get("Content-Type"), d.ContentTypes); err != nil {
+		removePart(part)
+		return false, 0, err
+	}
+	if offset > 0 {
+		log.Println(d.Url, " 从 ", offset, " 字节处继续下载")
+	} else {
+		info = &partInfo{
+			Url:          d.Url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Size:         total,
+		}
+		if err = writePartInfo(part, info); err != nil {
+			return false, 0, err
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if offset == 0 {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(part, flag, 0644)
+	if err != nil {
+		return false, 0, err
+	}
+	written, err := io.Copy(file, resp.Body)
+	if syncErr := file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// 已写入的部分保留, 重试时继续
+	if err != nil {
+		return true, 0, err
+	}
+	size := offset + written
+	if total >= 0 && size < total {
+		return true, 0, fmt.Errorf("文件不完整: 已下载 %d 字节, 应为 %d 字节", size, total)
+	}
+	if total >= 0 && size > total {
+		removePart(part)
+		return true, 0, fmt.Errorf("文件大小不符合: 已下载 %d 字节, 应为 %d 字节", size, total)
+	}
+	if d.Verify != nil {
+		if err = d.Verify(part); err != nil {
+			removePart(part)
+			return false, 0, err
+		}
+	}
+	if err = os.Rename(part, d.Path); err != nil {
+		return false, 0, err
+	}
+	os.Remove(part + ".json")
+	return false, 0, nil
+}
+
+// 解析 Content-Range: bytes 100-199/200, 总大小未知时为 -1
+func parseContentRange(s string) (start, total int64, err error) {
+	var end int64
+	var size string
+	if _, err = fmt.Sscanf(s, "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return 0, 0, err
+	}
+	if size == "*" {
+		return start, -1, nil
+	}
+	total, err = strconv.ParseInt(size, 10, 64)
+	return start, total, err
+}
+
+// 读取未完成下载的信息
+func readPartInfo(part string, info *partInfo) error {
+	data, err := ioutil.ReadFile(part + ".json")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, info)
+}
+
+// 保存未完成下载的信息
+func writePartInfo(part string, info *partInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(part+".json", data, 0644)
+}
+
+// 删除临时文件和下载信息
+func removePart(part string) {
+	os.Remove(part)
+	os.Remove(part + ".json")
+}
+
+// 统计图片目录中上次运行留下的未完成下载, 再次爬取到这些作品时会继续下载
+func (p *Pixiv) countParts() int {
+	count := 0
+	filepath.Walk(p.RootDir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.HasSuffix(path, partSuffix+".json") {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+// 检查Content-Type, 服务器没有返回时不检查
+func checkContentType(contentType string, allowed []string) error {
+	if len(allowed) == 0 || len(contentType) == 0 {
+		return nil
+	}
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range allowed {
+		if strings.HasPrefix(contentType, prefix) {
+			return nil
+		}
+	}
+	return fmt.Errorf("文件类型不符合: %s", contentType)
+}
+
+// 解码图片头, 确认格式与扩展名一致, width和height大于0时确认尺寸与作品信息一致
+func verifyImage(name, imgType string, width, height int) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return fmt.Errorf("图片解析失败: %v", err)
+	}
+	if imgType == "jpg" {
+		imgType = "jpeg"
+	}
+	if format != imgType {
+		return fmt.Errorf("图片格式不符合: %s, 应为 %s", format, imgType)
+	}
+	if width > 0 && height > 0 && (config.Width != width || config.Height != height) {
+		return fmt.Errorf("图片尺寸不符合: %dx%d, 应为 %dx%d", config.Width, config.Height, width, height)
+	}
+	return nil
+}
+
+// 写入文件: 先写临时文件再重命名
+func writeFileAtomic(name string, data []byte) error {
+	part := name + partSuffix
+	file, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(part, name)
+	}
+	if err != nil {
+		os.Remove(part)
+	}
+	return err
+}
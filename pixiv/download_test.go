@@ -0,0 +1,104 @@
+package pixiv
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		input        string
+		start, total int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, 200, true},
+		{"bytes 0-0/1", 0, 1, true},
+		{"bytes 100-199/*", 100, -1, true},
+		{"bytes */200", 0, 0, false},
+		{"bytes 100-199/abc", 100, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, total, err := parseContentRange(test.input)
+		if (err == nil) != test.ok {
+			t.Errorf("parseContentRange(%q) error = %v, want ok %v", test.input, err, test.ok)
+			continue
+		}
+		if test.ok && (start != test.start || total != test.total) {
+			t.Errorf("parseContentRange(%q) = %d, %d, want %d, %d", test.input, start, total, test.start, test.total)
+		}
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "1_p0.jpg", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+	fileUrl := server.URL + "/1_p0.jpg"
+
+	tests := []struct {
+		name string
+		// 已有的临时文件内容和续传信息, 为空时没有临时文件
+		part []byte
+		info *partInfo
+		// 期望的 Range 请求头
+		wantRange string
+	}{
+		{"没有临时文件", nil, nil, ""},
+		{"从临时文件末尾继续", content[:4000], &partInfo{Url: fileUrl, ETag: `"v1"`, Size: int64(len(content))}, "bytes=4000-"},
+		{"文件已变化时重新下载", []byte("changed"), &partInfo{Url: fileUrl, ETag: `"v0"`, Size: int64(len(content))}, "bytes=7-"},
+		{"地址不同时重新下载", content[:4000], &partInfo{Url: server.URL + "/2_p0.jpg", ETag: `"v1"`}, ""},
+		{"弱ETag不能续传", content[:4000], &partInfo{Url: fileUrl, ETag: `W/"v1"`}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pixiv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			name := filepath.Join(dir, "1_p0.jpg")
+			if test.part != nil {
+				if err = ioutil.WriteFile(name+partSuffix, test.part, 0644); err != nil {
+					t.Fatal(err)
+				}
+				if err = writePartInfo(name+partSuffix, test.info); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ranges = nil
+			p := &Pixiv{Client: server.Client(), Retry: DefaultRetryPolicy()}
+			if err = p.download(context.Background(), &download{Url: fileUrl, Path: name}); err != nil {
+				t.Fatal(err)
+			}
+			if len(ranges) != 1 || ranges[0] != test.wantRange {
+				t.Errorf("Range = %q, want [%q]", ranges, test.wantRange)
+			}
+			data, err := ioutil.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("下载的文件有 %d 字节, 内容与原文件不同", len(data))
+			}
+			for _, left := range []string{name + partSuffix, name + partSuffix + ".json"} {
+				if _, err = os.Stat(left); !os.IsNotExist(err) {
+					t.Errorf("%s 没有删除", left)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package pixiv
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// /ajax/illust/<id> 返回的作品详情
+type IllustInfo struct {
+	Id    string `json:"illustId"`
+	Title string `json:"illustTitle"`
+	// 作品类型 0: 插画 1: 漫画 2: 动图
+	IllustType int
+	// 0: 全年龄 1: R-18 2: R-18G
+	XRestrict int
+	// 0: 未知 1: 非AI生成 2: AI生成
+	AiType int
+	// 作者
+	UserId      string
+	UserName    string
+	UserAccount string
+	Width       int
+	Height      int
+	PageCount   int
+	// 收藏数, 点赞数, 浏览数, 评论数
+	BookmarkCount int
+	LikeCount     int
+	ViewCount     int
+	CommentCount  int
+	CreateDate    time.Time
+	UploadDate    time.Time
+	Tags          struct {
+		Tags []IllustTag
+	}
+	Urls struct {
+		Mini     string
+		Thumb    string
+		Small    string
+		Regular  string
+		Original string
+	}
+}
+
+// 作品标签
+type IllustTag struct {
+	Tag         string
+	Locked      bool
+	Translation map[string]string
+}
+
+// 所有标签名
+func (i *IllustInfo) TagNames() []string {
+	tags := make([]string, 0, len(i.Tags.Tags))
+	for _, tag := range i.Tags.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	return tags
+}
+
+// /ajax/illust/<id>/pages 返回的每一页的地址和尺寸
+type IllustPage struct {
+	Urls struct {
+		ThumbMini string `json:"thumb_mini"`
+		Small     string
+		Regular   string
+		Original  string
+	}
+	Width  int
+	Height int
+}
+
+// pixiv ajax接口的通用返回格式
+type ajaxResponse struct {
+	Error   bool
+	Message string
+	Body    json.RawMessage
+}
+
+// 请求pixiv的ajax接口, 并将body解析到v中, Cookie由账号池轮流选择
+func (p *Pixiv) getAjax(ctx context.Context, urlStr, referer string, v interface{}) error {
+	return p.getAjaxAs(ctx, "", urlStr, referer, v)
+}
+
+// 使用指定的Cookie请求pixiv的ajax接口, cookie为空时由账号池轮流选择
+func (p *Pixiv) getAjaxAs(ctx context.Context, cookie, urlStr, referer string, v interface{}) error {
+	header := &http.Header{}
+	header.Add("user-agent", GetRandomUserAgent())
+	if len(cookie) > 0 {
+		header.Add("cookie", cookie)
+	}
+	if len(referer) > 0 {
+		header.Add("referer", referer)
+	}
+	ajaxUrl, err := url.Parse(urlStr)
+	if err != nil {
+		return err
+	}
+	request := &http.Request{
+		Method: "GET",
+		URL:    ajaxUrl,
+		Header: *header,
+	}
+	resp, err := p.DoRequest(ctx, request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	res := &ajaxResponse{}
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return err
+	}
+	if res.Error {
+		return errors.New(res.Message)
+	}
+	return json.Unmarshal(res.Body, v)
+}
+
+// 缓存的作品详情数, 筛选和下载同一作品的间隔通常很短
+const infoCacheSize = 1000
+
+// 作品详情的LRU缓存, 超出容量时淘汰最久没有使用的作品
+type infoCache struct {
+	order *list.List
+	items map[string]*list.Element
+}
+
+type infoEntry struct {
+	id   string
+	info *IllustInfo
+}
+
+func newInfoCache() *infoCache {
+	return &infoCache{order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *infoCache) get(id string) (*IllustInfo, bool) {
+	elem, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*infoEntry).info, true
+}
+
+func (c *infoCache) add(id string, info *IllustInfo) {
+	if elem, ok := c.items[id]; ok {
+		elem.Value.(*infoEntry).info = info
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.items[id] = c.order.PushFront(&infoEntry{id: id, info: info})
+	if c.order.Len() > infoCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*infoEntry).id)
+	}
+}
+
+// 获取作品详情, 同一次爬取中最近使用的作品只请求一次
+func (p *Pixiv) IllustInfo(ctx context.Context, id string) (*IllustInfo, error) {
+	p.infoMutex.Lock()
+	info, ok := p.cachedInfo().get(id)
+	p.infoMutex.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info = &IllustInfo{}
+	if err := p.getAjax(ctx, "https://www.pixiv.net/ajax/illust/"+id, referUrl+id, info); err != nil {
+		return nil, err
+	}
+	p.infoMutex.Lock()
+	p.cachedInfo().add(id, info)
+	p.infoMutex.Unlock()
+	return info, nil
+}
+
+// 作品详情缓存, 需要持有 infoMutex
+func (p *Pixiv) cachedInfo() *infoCache {
+	if p.infoCache == nil {
+		p.infoCache = newInfoCache()
+	}
+	return p.infoCache
+}
+
+// 获取作品每一页的原图地址和尺寸
+func (p *Pixiv) IllustPages(ctx context.Context, id string) ([]IllustPage, error) {
+	var pages []IllustPage
+	err := p.getAjax(ctx, "https://www.pixiv.net/ajax/illust/"+id+"/pages", referUrl+id, &pages)
+	return pages, err
+}
+
+// 清空作品详情缓存
+func (p *Pixiv) resetInfoCache() {
+	p.infoMutex.Lock()
+	p.infoCache = nil
+	p.infoMutex.Unlock()
+}
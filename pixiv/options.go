@@ -0,0 +1,238 @@
+package pixiv
+
+import (
+	"log"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// 创建爬虫时的可选项
+type Option func(p *Pixiv)
+
+// 创建爬虫, 未指定的参数使用默认值:
+// 下载并发 30, 请求并发 50, 按 DefaultRateLimits 限速, 收藏数 1000, 类型 wh, 只下载第一页, 动图合成gif, 保存到 images
+func New(options ...Option) *Pixiv {
+	nowTime := time.Now()
+	limiter, _ := NewRateLimiter(DefaultRateLimits)
+	p := &Pixiv{
+		GoroutinePool: make(chan struct{}, 30),    // 设置线程数量
+		PicChan:       make(chan *PicDetail, 200), // 存储图片id的通道
+		RequestPool:   make(chan struct{}, 50),    // 通过DoRequest方法限制请求并发度
+		wallpaperPool: make(chan struct{}, runtime.NumCPU()),
+		ugoiraPool:    make(chan struct{}, ugoiraConcurrency),
+		Client:        &http.Client{Timeout: 10 * time.Minute},
+		CountDown:     &sync.WaitGroup{},     // 控制程序平稳结束的栅栏
+		Memo:          make(map[string]bool), // 缓存，防止下载重复图片
+		Mutex:         &sync.Mutex{},
+		Limiter:       limiter,
+		ImageDir:      "images",
+		Bookmarks:     1000,
+		PicType:       "wh",
+		EndTime:       &nowTime,
+		PageLimit:     1,
+		UgoiraFormat:  "gif",
+	}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// 使用配置中的并发数、保存目录以及默认的收藏数和图片类型
+func WithConfig(config *Config) Option {
+	return func(p *Pixiv) {
+		p.GoroutinePool = make(chan struct{}, config.Concurrency)
+		p.RequestPool = make(chan struct{}, config.Requests)
+		p.ImageDir = config.ImageDir
+		p.Bookmarks = config.Bookmarks
+		p.PicType = config.PicType
+		if limiter, err := NewRateLimiter(config.RateLimits); err == nil {
+			p.Limiter = limiter
+		}
+		if displays, err := ParseDisplays(config.Displays, config.DisplayTolerance); err == nil {
+			p.Displays = displays
+		}
+		if wallpaper, err := ParseWallpaperOptions(config.Wallpapers, config.WallpaperCrop); err == nil {
+			p.Wallpaper = wallpaper
+		}
+		if len(config.RulesFile) > 0 {
+			rules, err := LoadRules(config.RulesFile)
+			if err != nil {
+				log.Println("规则加载失败, 使用默认规则: ", err)
+				return
+			}
+			p.Rules = rules
+		}
+	}
+}
+
+// 同时下载的图片数
+func WithConcurrency(n int) Option {
+	return func(p *Pixiv) {
+		p.GoroutinePool = make(chan struct{}, n)
+	}
+}
+
+// 同时进行的接口请求数
+func WithRequests(n int) Option {
+	return func(p *Pixiv) {
+		p.RequestPool = make(chan struct{}, n)
+	}
+}
+
+// http请求客户端
+func WithClient(client *http.Client) Option {
+	return func(p *Pixiv) {
+		p.Client = client
+	}
+}
+
+// 登录后的Cookie
+func WithCookie(cookie string) Option {
+	return func(p *Pixiv) {
+		p.Cookie = cookie
+	}
+}
+
+// 多账号Cookie池, 账号相关的请求使用第一个可用的账号
+func WithAccounts(pool *CookiePool) Option {
+	return func(p *Pixiv) {
+		p.Accounts = pool
+	}
+}
+
+// 爬取策略和对应的关键字(搜索词、图片ID或作者ID)
+func WithStrategy(strategy Strategy, keyword string) Option {
+	return func(p *Pixiv) {
+		p.Strategy = strategy
+		p.KeyWord = keyword
+	}
+}
+
+// 搜索时标签的匹配方式 s_tag_full, s_tag 或 s_tc
+func WithSearchMode(mode string) Option {
+	return func(p *Pixiv) {
+		p.SearchMode = mode
+	}
+}
+
+// 已下载作品的记录存储, 不指定时在运行时打开保存目录下的存储
+func WithStore(store *Store) Option {
+	return func(p *Pixiv) {
+		p.Store = store
+	}
+}
+
+// 图片保存的根目录
+func WithImageDir(dir string) Option {
+	return func(p *Pixiv) {
+		p.ImageDir = dir
+	}
+}
+
+// 要求的最低收藏数
+func WithBookmarks(bookmarks int) Option {
+	return func(p *Pixiv) {
+		p.Bookmarks = bookmarks
+	}
+}
+
+// 爬取的图片类型 w: 横屏 h: 竖屏 s: 小屏 o: 其他
+func WithPicType(picType string) Option {
+	return func(p *Pixiv) {
+		p.PicType = picType
+	}
+}
+
+// 筛选规则, 不指定时使用 DefaultRules
+func WithRules(rules []Rule) Option {
+	return func(p *Pixiv) {
+		p.Rules = rules
+	}
+}
+
+// 目标显示器
+func WithDisplays(displays []Display) Option {
+	return func(p *Pixiv) {
+		p.Displays = displays
+	}
+}
+
+// 壁纸后处理
+func WithWallpaper(options *WallpaperOptions) Option {
+	return func(p *Pixiv) {
+		p.Wallpaper = options
+	}
+}
+
+// 按域名限制请求速率, 为nil时不限制
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(p *Pixiv) {
+		p.Limiter = limiter
+	}
+}
+
+// 请求的重试策略
+func WithRetry(policy *RetryPolicy) Option {
+	return func(p *Pixiv) {
+		p.Retry = policy
+	}
+}
+
+// 是否爬取R-18作品
+func WithR18(r18 bool) Option {
+	return func(p *Pixiv) {
+		p.R18 = r18
+	}
+}
+
+// 爬取时间终点
+func WithEndTime(endTime time.Time) Option {
+	return func(p *Pixiv) {
+		p.EndTime = &endTime
+	}
+}
+
+// 爬取时间起点
+func WithStartTime(startTime time.Time) Option {
+	return func(p *Pixiv) {
+		p.StartTime = &startTime
+	}
+}
+
+// 多图作品下载的页数, 0 表示全部
+func WithPageLimit(limit int) Option {
+	return func(p *Pixiv) {
+		p.PageLimit = limit
+	}
+}
+
+// 动图合成格式
+func WithUgoiraFormat(format string) Option {
+	return func(p *Pixiv) {
+		p.UgoiraFormat = format
+	}
+}
+
+// 重复下载已下载图片的概率 0 - 100
+func WithRepetitionOdds(odds int) Option {
+	return func(p *Pixiv) {
+		p.RepetitionOdds = odds
+	}
+}
+
+// 从上次中断的断点继续爬取
+func WithResume(resume bool) Option {
+	return func(p *Pixiv) {
+		p.Resume = resume
+	}
+}
+
+// 事件回调
+func WithEvents(events Events) Option {
+	return func(p *Pixiv) {
+		p.Events = events
+	}
+}
@@ -0,0 +1,202 @@
+package pixiv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 统计实际速率的时间窗口, 与状态日志的间隔相同
+	rateWindow = 3 * time.Second
+	// 降速后至少经过这段时间才开始恢复
+	rateCooldown = 30 * time.Second
+	// 最多降低到设定速率的 1/16
+	minRateFactor = 1.0 / 16
+)
+
+// 默认的每秒请求数: ajax接口5次, 图片10次
+var DefaultRateLimits = map[string]float64{
+	"www.pixiv.net": 5,
+	"i.pximg.net":   10,
+}
+
+// 令牌桶: 以rate的速度生成令牌, 最多积累burst个
+// 遇到限流时速率减半, 冷却后每次成功的请求逐步恢复到设定速率
+type TokenBucket struct {
+	mutex sync.Mutex
+	// 设定速率和当前速率, 每秒请求数
+	limit, rate float64
+	burst       float64
+	tokens      float64
+	last        time.Time
+	// 最近一次降速的时间
+	slowed time.Time
+	// 最近 rateWindow 内发放令牌的时间, 用于计算实际速率
+	granted []time.Time
+}
+
+// 创建令牌桶, 初始时令牌是满的
+func NewTokenBucket(rate float64) *TokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{limit: rate, rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// 等待一个令牌, ctx取消时返回错误
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mutex.Lock()
+		now := time.Now()
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.granted = append(b.prune(now), now)
+			b.mutex.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.mutex.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// 遇到限流时速率减半, 同时发出的请求往往一起被限流, rateWindow 内只减半一次
+func (b *TokenBucket) Slowdown() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if time.Since(b.slowed) < rateWindow {
+		return
+	}
+	b.rate /= 2
+	if b.rate < b.limit*minRateFactor {
+		b.rate = b.limit * minRateFactor
+	}
+	b.slowed = time.Now()
+}
+
+// 请求成功, 冷却后每次恢复设定速率的5%
+func (b *TokenBucket) Success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.rate >= b.limit || time.Since(b.slowed) < rateCooldown {
+		return
+	}
+	b.rate += b.limit / 20
+	if b.rate > b.limit {
+		b.rate = b.limit
+	}
+}
+
+// 设定速率, 当前允许的速率和最近的实际速率
+func (b *TokenBucket) Rates() (limit, rate, effective float64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.granted = b.prune(time.Now())
+	return b.limit, b.rate, float64(len(b.granted)) / rateWindow.Seconds()
+}
+
+// 去掉时间窗口之前的记录
+func (b *TokenBucket) prune(now time.Time) []time.Time {
+	i := 0
+	for i < len(b.granted) && now.Sub(b.granted[i]) > rateWindow {
+		i++
+	}
+	return b.granted[i:]
+}
+
+// 按域名限制请求速率, 子域名同样匹配, 优先匹配最长的域名, 没有匹配的域名不限制
+type RateLimiter struct {
+	buckets map[string]*TokenBucket
+}
+
+// 创建限速器, rates为域名 -> 每秒请求数
+func NewRateLimiter(rates map[string]float64) (*RateLimiter, error) {
+	limiter := &RateLimiter{buckets: make(map[string]*TokenBucket)}
+	for host, rate := range rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("%s 的请求速率必须大于0: %v", host, rate)
+		}
+		limiter.buckets[strings.ToLower(host)] = NewTokenBucket(rate)
+	}
+	return limiter, nil
+}
+
+// 查找域名对应的令牌桶
+func (l *RateLimiter) bucket(host string) *TokenBucket {
+	host = strings.ToLower(host)
+	matched := ""
+	for rule := range l.buckets {
+		if (host == rule || strings.HasSuffix(host, "."+rule)) && len(rule) > len(matched) {
+			matched = rule
+		}
+	}
+	return l.buckets[matched]
+}
+
+// 等待请求的令牌
+func (l *RateLimiter) Wait(ctx context.Context, req *http.Request) error {
+	if bucket := l.bucket(req.URL.Hostname()); bucket != nil {
+		return bucket.Wait(ctx)
+	}
+	return nil
+}
+
+// 根据响应调整速率: 429或验证码页面时降速, 成功时逐步恢复
+func (l *RateLimiter) Observe(req *http.Request, resp *http.Response) {
+	bucket := l.bucket(req.URL.Hostname())
+	if bucket == nil {
+		return
+	}
+	if isThrottled(resp) {
+		bucket.Slowdown()
+	} else if resp.StatusCode < 400 {
+		bucket.Success()
+	}
+}
+
+// 是否被限流: 429, 或返回了验证码页面(Cloudflare质询或403的html页面)
+func isThrottled(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusTooManyRequests || len(resp.Header.Get("cf-mitigated")) > 0 {
+		return true
+	}
+	return resp.StatusCode == http.StatusForbidden &&
+		strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/html")
+}
+
+// 各域名的速率, 如 "i.pximg.net 9.7/10 www.pixiv.net 2.0/2.5(5)"
+// 斜杠前为最近的实际速率, 后为当前允许的速率, 降速时括号中为设定速率
+func (l *RateLimiter) String() string {
+	hosts := make([]string, 0, len(l.buckets))
+	for host := range l.buckets {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	var parts []string
+	for _, host := range hosts {
+		limit, rate, effective := l.buckets[host].Rates()
+		part := fmt.Sprintf("%s %.1f/%g", host, effective, rate)
+		if rate < limit {
+			part += fmt.Sprintf("(%g)", limit)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
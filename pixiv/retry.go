@@ -0,0 +1,190 @@
+package pixiv
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 调用处名称, 用于区分重试次数和日志
+const (
+	RetryDefault  = "请求"
+	RetrySearch   = "搜索"
+	RetryRelated  = "相关作品"
+	RetryDownload = "下载"
+)
+
+// 重试策略: 指数退避加随机抖动, 优先使用服务器返回的 Retry-After
+// 网络错误和5xx按退避时间重试, 429至少等待 RateLimitDelay, 403最多重试 ForbiddenRetries 次, 其他状态码不重试
+type RetryPolicy struct {
+	// 默认的最多重试次数
+	MaxRetries int
+	// 各调用处的最多重试次数, 未设置的使用 MaxRetries
+	Budgets map[string]int
+	// 第一次重试的等待时间, 之后每次翻倍
+	BaseDelay time.Duration
+	// 退避时间的上限
+	MaxDelay time.Duration
+	// 429 且没有 Retry-After 时的最短等待时间
+	RateLimitDelay time.Duration
+	// Retry-After 的上限, 避免异常的响应让请求等待过久, 为0时使用 MaxDelay
+	MaxRetryAfter time.Duration
+	// 403 的最多重试次数, 通常是Cookie失效或被限制, 多次重试没有意义
+	ForbiddenRetries int
+}
+
+// 默认策略: 重试3次, 搜索重试10次, 等待时间从500毫秒开始翻倍, 最长30秒
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxRetries: 3,
+		Budgets: map[string]int{
+			RetrySearch: 10,
+		},
+		BaseDelay:        500 * time.Millisecond,
+		MaxDelay:         30 * time.Second,
+		RateLimitDelay:   time.Minute,
+		MaxRetryAfter:    5 * time.Minute,
+		ForbiddenRetries: 1,
+	}
+}
+
+// 调用处的最多重试次数
+func (r *RetryPolicy) Budget(site string) int {
+	if budget, ok := r.Budgets[site]; ok {
+		return budget
+	}
+	return r.MaxRetries
+}
+
+// 第attempt次重试的等待时间, 在退避时间的一半到全部之间随机
+func (r *RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := r.BaseDelay
+	for i := 1; i < attempt && delay < r.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxDelay {
+		delay = r.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// 判断响应是否需要重试, 返回原因和最短等待时间
+func (r *RetryPolicy) retryable(resp *http.Response, forbidden int) (reason string, wait time.Duration, ok bool) {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait = r.retryAfter(resp)
+		if wait == 0 {
+			wait = r.RateLimitDelay
+		}
+		return resp.Status, wait, true
+	case resp.StatusCode == http.StatusForbidden:
+		return resp.Status, 0, forbidden < r.ForbiddenRetries
+	case resp.StatusCode >= 500:
+		return resp.Status, r.retryAfter(resp), true
+	}
+	return "", 0, false
+}
+
+// 服务器要求的等待时间, 不超过 MaxRetryAfter
+func (r *RetryPolicy) retryAfter(resp *http.Response) time.Duration {
+	limit := r.MaxRetryAfter
+	if limit <= 0 {
+		limit = r.MaxDelay
+	}
+	if wait := retryAfter(resp); wait < limit {
+		return wait
+	}
+	return limit
+}
+
+// 解析 Retry-After, 支持秒数和http日期, 没有或无法解析时返回0
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(time.Now()) {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// 按重试策略执行请求, 所有重试都失败时返回最后一次的响应或错误
+// 需要重试的响应会被关闭, 请求不能带有body
+func (p *Pixiv) retry(ctx context.Context, site string, do func() (*http.Response, error)) (*http.Response, error) {
+	policy := p.retryPolicy()
+	budget := policy.Budget(site)
+	forbidden := 0
+	for attempt := 1; ; attempt++ {
+		resp, err := do()
+		if ctx.Err() != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+		reason := ""
+		var wait time.Duration
+		if err != nil {
+			reason = err.Error()
+		} else {
+			var ok bool
+			if reason, wait, ok = policy.retryable(resp, forbidden); !ok {
+				return resp, nil
+			}
+			if resp.StatusCode == http.StatusForbidden {
+				forbidden++
+			}
+		}
+		if attempt > budget {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !p.waitRetry(ctx, site, attempt, reason, wait) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// 记录重试原因并等待退避时间, 不少于wait, ctx取消时返回false
+// 调用处在响应内容不符合预期时也可以用它等待后重试
+func (p *Pixiv) RetryWait(ctx context.Context, site string, attempt int, reason string) bool {
+	if attempt > p.retryPolicy().Budget(site) {
+		return false
+	}
+	return p.waitRetry(ctx, site, attempt, reason, 0)
+}
+
+func (p *Pixiv) waitRetry(ctx context.Context, site string, attempt int, reason string, wait time.Duration) bool {
+	delay := p.retryPolicy().Backoff(attempt)
+	if delay < wait {
+		delay = wait
+	}
+	log.Println(site, " 第 ", attempt, " 次重试, 原因: ", reason, ", 等待 ", delay)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *Pixiv) retryPolicy() *RetryPolicy {
+	if p.Retry == nil {
+		return DefaultRetryPolicy()
+	}
+	return p.Retry
+}
@@ -0,0 +1,322 @@
+package pixiv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 筛选条件, 未设置的条件不限制, 需要收藏数等作品详情的条件在其他条件满足后才会请求
+type Condition struct {
+	// 宽度和高度范围
+	MinWidth, MaxWidth   int `json:",omitempty"`
+	MinHeight, MaxHeight int `json:",omitempty"`
+	// 长边和短边的最小值
+	MinLong, MinShort int `json:",omitempty"`
+	// 长边与短边的比例范围, 不含边界
+	MinRatio, MaxRatio float32 `json:",omitempty"`
+	// landscape: 横图(宽大于高) portrait: 竖图(宽不大于高)
+	Orientation string `json:",omitempty"`
+	// 最低收藏数, 浏览数, 点赞数
+	MinBookmarks, MinViews, MinLikes int `json:",omitempty"`
+	// 包含任一标签, 不区分大小写的部分匹配
+	Tags []string `json:",omitempty"`
+	// 不能包含的标签, 匹配方式同上
+	ExcludeTags []string `json:",omitempty"`
+	// 作者ID或名字
+	Authors        []string `json:",omitempty"`
+	ExcludeAuthors []string `json:",omitempty"`
+	// 发布时间范围, 格式 2006-01-02
+	CreatedAfter, CreatedBefore string `json:",omitempty"`
+	// 页数范围
+	MinPages, MaxPages int `json:",omitempty"`
+	// true: 只要AI生成的作品 false: 排除AI生成的作品
+	AI *bool `json:",omitempty"`
+	// 限制级别 0: 全年龄 1: R-18 2: R-18G
+	XRestrict []int `json:",omitempty"`
+}
+
+// 筛选规则: 按顺序找到第一条满足When的规则
+// Reject 为 true 时丢弃作品, Prefix 为 true 时在目录前加上Group并继续匹配后续规则,
+// 否则作品还需满足Require, 满足时保存到 Group 目录, 不满足时丢弃
+type Rule struct {
+	// 规则名, 作品被丢弃时作为原因
+	Name    string
+	Group   string    `json:",omitempty"`
+	When    Condition `json:",omitempty"`
+	Require Condition `json:",omitempty"`
+	Prefix  bool      `json:",omitempty"`
+	Reject  bool      `json:",omitempty"`
+}
+
+// AI生成作品的aiType
+const aiGenerated = 2
+
+// 默认规则, 与之前的筛选方式相同:
+// 标签含 r-18 的作品在开启R18时放到 R-18 目录下, 否则丢弃;
+// 长边不小于1750且短边不小于900的为大图, 比例在1.4到2.15之间的横图为宽屏, 竖图为竖屏, 其余为其他, 不是大图的为小屏;
+// picType中不包含的类型丢弃, 保留的类型要求收藏数不低于bookmarks
+func DefaultRules(picType string, r18 bool, bookmarks int) []Rule {
+	r18Rule := Rule{Name: "R-18", When: Condition{Tags: []string{"r-18"}}}
+	if r18 {
+		r18Rule.Group = "R-18"
+		r18Rule.Prefix = true
+	} else {
+		r18Rule.Reject = true
+	}
+	big := Condition{MinLong: 1750, MinShort: 900}
+	wide := big
+	wide.MinRatio, wide.MaxRatio = 1.4, 2.15
+	tall := wide
+	wide.Orientation, tall.Orientation = "landscape", "portrait"
+	rules := []Rule{r18Rule}
+	for _, class := range []struct {
+		code, group string
+		when        Condition
+	}{
+		{"w", "宽屏", wide},
+		{"h", "竖屏", tall},
+		{"o", "其他", big},
+		{"s", "小屏", Condition{}},
+	} {
+		rule := Rule{Name: class.group, Group: class.group, When: class.when}
+		if strings.Contains(picType, class.code) {
+			rule.Require = Condition{MinBookmarks: bookmarks}
+		} else {
+			rule.Name = "尺寸不符合图片类型 " + picType
+			rule.Group = ""
+			rule.Reject = true
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// 目标显示器模式的默认规则: 尺寸由显示器筛选, 只保留R-18和收藏数的规则, 不再按图片类型分组, 都保存到 显示器 目录
+func DisplayRules(r18 bool, bookmarks int) []Rule {
+	rules := DefaultRules("", r18, bookmarks)[:1]
+	return append(rules, Rule{Name: "显示器", Group: "显示器", Require: Condition{MinBookmarks: bookmarks}})
+}
+
+// 从json文件读取规则列表
+func LoadRules(name string) ([]Rule, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("规则文件 %s 解析失败: %v", name, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("规则文件 %s 中没有规则", name)
+	}
+	for i := range rules {
+		if err = rules[i].Validate(); err != nil {
+			return nil, fmt.Errorf("规则文件 %s 第 %d 条规则: %v", name, i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+// 校验规则
+func (r *Rule) Validate() error {
+	if len(r.Name) == 0 {
+		return errors.New("Name 不能为空")
+	}
+	if r.Reject && r.Prefix {
+		return errors.New("Reject 和 Prefix 不能同时设置")
+	}
+	if !r.Reject && len(r.Group) == 0 {
+		return errors.New("Group 不能为空")
+	}
+	if err := r.When.Validate(); err != nil {
+		return err
+	}
+	return r.Require.Validate()
+}
+
+// 校验条件
+func (c *Condition) Validate() error {
+	switch c.Orientation {
+	case "", "landscape", "portrait":
+	default:
+		return fmt.Errorf("Orientation 只能为 landscape 或 portrait: %s", c.Orientation)
+	}
+	for _, date := range []string{c.CreatedAfter, c.CreatedBefore} {
+		if _, err := parseDate(date); err != nil {
+			return fmt.Errorf("日期格式错误: %s", date)
+		}
+	}
+	return nil
+}
+
+// 解析日期, 为空时返回零值
+func parseDate(date string) (time.Time, error) {
+	if len(date) == 0 {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation("2006-01-02", date, time.Local)
+}
+
+// 按规则筛选作品, 返回保存的分组; 不通过时返回原因
+// 获取了作品详情时会更新作品的收藏数、页数和类型
+func (p *Pixiv) ApplyRules(ctx context.Context, illust *Illust) (group string, reason string, ok bool) {
+	rules := p.Rules
+	if rules == nil && len(p.Displays) > 0 {
+		rules = DisplayRules(p.R18, p.Bookmarks)
+	} else if rules == nil {
+		rules = DefaultRules(p.PicType, p.R18, p.Bookmarks)
+	}
+	var info *IllustInfo
+	getInfo := func() (*IllustInfo, error) {
+		if info != nil {
+			return info, nil
+		}
+		var err error
+		if info, err = p.IllustInfo(ctx, illust.Id); err != nil {
+			return nil, err
+		}
+		illust.BookmarkData = info.BookmarkCount
+		illust.PageCount = info.PageCount
+		illust.IllustType = info.IllustType
+		return info, nil
+	}
+
+	prefix := ""
+	for _, rule := range rules {
+		matched, _, err := rule.When.match(illust, getInfo)
+		if err != nil {
+			return "", "作品详情获取失败", false
+		}
+		if !matched {
+			continue
+		}
+		if rule.Reject {
+			return "", rule.Name, false
+		}
+		if rule.Prefix {
+			prefix += rule.Group + "/"
+			continue
+		}
+		matched, failed, err := rule.Require.match(illust, getInfo)
+		if err != nil {
+			return "", "作品详情获取失败", false
+		}
+		if !matched {
+			return "", failed, false
+		}
+		return strings.TrimSuffix(prefix+rule.Group, "/"), "", true
+	}
+	return "", "没有匹配的规则", false
+}
+
+// 判断作品是否满足条件, 不满足时返回原因
+// 只有其他条件都满足时才通过getInfo获取作品详情
+func (c *Condition) match(illust *Illust, getInfo func() (*IllustInfo, error)) (bool, string, error) {
+	w, h := illust.Width, illust.Height
+	long, short := w, h
+	if h > w {
+		long, short = h, w
+	}
+	ratio := float32(long) / float32(short)
+	switch {
+	case w < c.MinWidth || (c.MaxWidth > 0 && w > c.MaxWidth):
+		return false, "宽度不符合 " + strconv.Itoa(w), nil
+	case h < c.MinHeight || (c.MaxHeight > 0 && h > c.MaxHeight):
+		return false, "高度不符合 " + strconv.Itoa(h), nil
+	case long < c.MinLong || short < c.MinShort:
+		return false, "尺寸不足 " + strconv.Itoa(w) + "x" + strconv.Itoa(h), nil
+	case (c.MinRatio > 0 && ratio <= c.MinRatio) || (c.MaxRatio > 0 && ratio >= c.MaxRatio):
+		return false, "比例不符合 " + strconv.FormatFloat(float64(ratio), 'f', 2, 32), nil
+	case c.Orientation == "landscape" && w <= h, c.Orientation == "portrait" && w > h:
+		return false, "方向不符合", nil
+	case len(c.Tags) > 0 && !containsTag(illust.Tags, c.Tags):
+		return false, "不包含指定标签", nil
+	case containsTag(illust.Tags, c.ExcludeTags):
+		return false, "包含排除的标签", nil
+	case len(c.Authors) > 0 && !isAuthor(illust, c.Authors):
+		return false, "不是指定的作者", nil
+	case isAuthor(illust, c.ExcludeAuthors):
+		return false, "是排除的作者", nil
+	}
+	// 没有页数时需要从作品详情获取
+	if (c.MinPages > 0 || c.MaxPages > 0) && illust.PageCount == 0 {
+		if _, err := getInfo(); err != nil {
+			return false, "", err
+		}
+	}
+	if illust.PageCount < c.MinPages || (c.MaxPages > 0 && illust.PageCount > c.MaxPages) {
+		return false, "页数不符合 " + strconv.Itoa(illust.PageCount), nil
+	}
+	if !c.needsInfo() {
+		return true, "", nil
+	}
+
+	info, err := getInfo()
+	if err != nil {
+		return false, "", err
+	}
+	after, _ := parseDate(c.CreatedAfter)
+	before, _ := parseDate(c.CreatedBefore)
+	switch {
+	case info.BookmarkCount < c.MinBookmarks:
+		return false, "收藏数不足 " + strconv.Itoa(info.BookmarkCount), nil
+	case info.ViewCount < c.MinViews:
+		return false, "浏览数不足 " + strconv.Itoa(info.ViewCount), nil
+	case info.LikeCount < c.MinLikes:
+		return false, "点赞数不足 " + strconv.Itoa(info.LikeCount), nil
+	case c.AI != nil && *c.AI != (info.AiType == aiGenerated):
+		return false, "AI生成不符合", nil
+	case len(c.XRestrict) > 0 && !containsInt(c.XRestrict, info.XRestrict):
+		return false, "限制级别不符合 " + strconv.Itoa(info.XRestrict), nil
+	case !after.IsZero() && info.CreateDate.Before(after):
+		return false, "发布时间过早 " + info.CreateDate.Format("2006-01-02"), nil
+	case !before.IsZero() && !info.CreateDate.Before(before.AddDate(0, 0, 1)):
+		return false, "发布时间过晚 " + info.CreateDate.Format("2006-01-02"), nil
+	}
+	return true, "", nil
+}
+
+// 是否有需要作品详情才能判断的条件
+func (c *Condition) needsInfo() bool {
+	return c.MinBookmarks > 0 || c.MinViews > 0 || c.MinLikes > 0 || c.AI != nil ||
+		len(c.XRestrict) > 0 || len(c.CreatedAfter) > 0 || len(c.CreatedBefore) > 0
+}
+
+// 作品标签中是否包含任一标签, 不区分大小写的部分匹配
+func containsTag(tags, patterns []string) bool {
+	for _, tag := range tags {
+		tag = strings.ToLower(tag)
+		for _, pattern := range patterns {
+			if strings.Contains(tag, strings.ToLower(pattern)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 作者ID或名字是否在列表中
+func isAuthor(illust *Illust, authors []string) bool {
+	for _, author := range authors {
+		if author == illust.UserId || author == illust.UserName {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(nums []int, n int) bool {
+	for _, num := range nums {
+		if num == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package pixiv
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 作品记录的追加日志, 每行一条json记录, 同一ID以最后一条为准
+	storeName = "memos.db"
+	// 旧版本以空格分隔ID的缓存文件
+	legacyMemoName = "memos"
+)
+
+// 已下载作品的记录
+type Record struct {
+	Id        string
+	Title     string   `json:",omitempty"`
+	UserId    string   `json:",omitempty"`
+	UserName  string   `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+	Width     int      `json:",omitempty"`
+	Height    int      `json:",omitempty"`
+	Bookmarks int      `json:",omitempty"`
+	PageCount int      `json:",omitempty"`
+	// 原图地址的来源 pages: 作品页面接口 guess: 根据缩略图地址猜测
+	UrlSource string `json:",omitempty"`
+	// 本地保存的文件
+	Files []StoredFile `json:",omitempty"`
+	// 下载完成时间
+	DownloadTime time.Time
+}
+
+// 本地文件路径及校验信息
+type StoredFile struct {
+	Path   string
+	Size   int64
+	Sha256 string
+	// 下载地址, 合成的文件为空
+	Url string `json:",omitempty"`
+}
+
+// 基于追加日志的作品记录存储, 每次写入都会fsync, 崩溃时最多丢失最后一条不完整的记录
+type Store struct {
+	mutex   sync.Mutex
+	dir     string
+	file    *os.File
+	records map[string]*Record
+	// 日志中的总行数, 用于判断是否需要压缩
+	lines int
+}
+
+// 打开dir目录下的记录存储, 旧的memos文件存在时迁移
+func OpenStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:     dir,
+		records: make(map[string]*Record),
+	}
+	name := filepath.Join(dir, storeName)
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = file
+	if err = s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// 迁移完成后旧文件会被重命名, 上次迁移中途崩溃时会再次迁移
+	if err = s.migrate(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	// 过期记录过多时压缩日志
+	if s.lines > 2*len(s.records)+1000 {
+		if err = s.Compact(); err != nil {
+			log.Println("记录压缩失败 ", err)
+		}
+	}
+	return s, nil
+}
+
+// 逐行读取日志, 截断末尾因崩溃而写了一半的记录
+func (s *Store) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// 没有换行结尾的行是未写完的记录
+			break
+		}
+		if err != nil {
+			return err
+		}
+		record := &Record{}
+		if e := json.Unmarshal(line, record); e != nil || len(record.Id) == 0 {
+			log.Println("跳过损坏的记录: ", strings.TrimSpace(string(line)))
+		} else {
+			s.records[record.Id] = record
+		}
+		s.lines++
+		offset += int64(len(line))
+	}
+	if err := s.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// 将旧版本的memos文件导入记录存储, 已有记录的ID不会被覆盖
+func (s *Store) migrate() error {
+	legacy := filepath.Join(s.dir, legacyMemoName)
+	file, err := os.Open(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var records []*Record
+	scanner := bufio.NewScanner(file)
+	scanner.Split(bufio.ScanWords)
+	for scanner.Scan() {
+		if !s.Has(scanner.Text()) {
+			records = append(records, &Record{Id: scanner.Text()})
+		}
+	}
+	file.Close()
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if err = s.Put(records...); err != nil {
+		return err
+	}
+	log.Println("已从 ", legacy, " 迁移 ", len(records), " 条记录")
+	return os.Rename(legacy, legacy+".migrated")
+}
+
+// 判断作品是否已经记录
+func (s *Store) Has(id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.records[id]
+	return ok
+}
+
+// 获取作品记录
+func (s *Store) Get(id string) (Record, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	record, ok := s.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	return *record, true
+}
+
+// 所有已记录的作品ID
+func (s *Store) Ids() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]string, 0, len(s.records))
+	for id := range s.records {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// 追加写入记录并落盘
+func (s *Store) Put(records ...*Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, 256*len(records))
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.file.Write(buf); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	for _, record := range records {
+		s.records[record.Id] = record
+	}
+	s.lines += len(records)
+	return nil
+}
+
+// 压缩日志: 只保留每个作品的最新记录, 写入临时文件后原子替换
+func (s *Store) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ids := make([]string, 0, len(s.records))
+	for id := range s.records {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	name := filepath.Join(s.dir, storeName)
+	tmpName := name + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, id := range ids {
+		line, err := json.Marshal(s.records[id])
+		if err == nil {
+			writer.Write(line)
+			err = writer.WriteByte('\n')
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	if err = writer.Flush(); err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	// windows下无法替换已打开的文件, 先关闭旧日志
+	s.file.Close()
+	if err = os.Rename(tmpName, name); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		s.file, _ = os.OpenFile(name, os.O_RDWR|os.O_APPEND, 0644)
+		return err
+	}
+	syncDir(s.dir)
+	s.file = tmp
+	s.lines = len(ids)
+	return nil
+}
+
+// 关闭记录存储
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
+
+// 同步目录, 保证重命名落盘, 部分系统不支持时忽略
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// 计算本地文件的大小和sha256
+func checksumFile(name string) (StoredFile, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return StoredFile{}, err
+	}
+	return StoredFile{
+		Path:   filepath.ToSlash(name),
+		Size:   size,
+		Sha256: hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
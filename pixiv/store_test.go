@@ -0,0 +1,126 @@
+package pixiv
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// 在临时目录中写入记录日志和旧版本的memos文件, 内容为空时不创建
+func writeStoreFiles(t *testing.T, db, legacy string) string {
+	dir, err := ioutil.TempDir("", "pixiv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(db) > 0 {
+		if err = ioutil.WriteFile(filepath.Join(dir, storeName), []byte(db), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(legacy) > 0 {
+		if err = ioutil.WriteFile(filepath.Join(dir, legacyMemoName), []byte(legacy), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// 检查记录的ID和标题
+func checkRecords(t *testing.T, s *Store, ids []string, titles map[string]string) {
+	got := s.Ids()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, ids) {
+		t.Errorf("Ids() = %v, want %v", got, ids)
+	}
+	for id, title := range titles {
+		if record, _ := s.Get(id); record.Title != title {
+			t.Errorf("Get(%s).Title = %q, want %q", id, record.Title, title)
+		}
+	}
+}
+
+func TestStoreLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		db     string
+		ids    []string
+		titles map[string]string
+		// 加载后保留的日志内容
+		kept string
+	}{
+		{"空日志", "", []string{}, nil, ""},
+		{"完整的记录", "{\"Id\":\"1\"}\n{\"Id\":\"2\"}\n", []string{"1", "2"}, nil, "{\"Id\":\"1\"}\n{\"Id\":\"2\"}\n"},
+		{"截断未写完的记录", "{\"Id\":\"1\"}\n{\"Id\":\"2\"", []string{"1"}, nil, "{\"Id\":\"1\"}\n"},
+		{"跳过损坏的记录", "{\"Id\":\"1\"}\nbroken\n{}\n{\"Id\":\"3\"}\n", []string{"1", "3"}, nil, "{\"Id\":\"1\"}\nbroken\n{}\n{\"Id\":\"3\"}\n"},
+		{"同一ID以最后一条为准", "{\"Id\":\"1\",\"Title\":\"a\"}\n{\"Id\":\"1\",\"Title\":\"b\"}\n", []string{"1"},
+			map[string]string{"1": "b"}, "{\"Id\":\"1\",\"Title\":\"a\"}\n{\"Id\":\"1\",\"Title\":\"b\"}\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeStoreFiles(t, test.db, "")
+			defer os.RemoveAll(dir)
+			store, err := OpenStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRecords(t, store, test.ids, test.titles)
+			// 新记录追加在截断后的位置
+			if err = store.Put(&Record{Id: "9"}); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+			data, err := ioutil.ReadFile(filepath.Join(dir, storeName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := test.kept + "{\"Id\":\"9\",\"DownloadTime\":\"0001-01-01T00:00:00Z\"}\n"; string(data) != want {
+				t.Errorf("日志内容 = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestStoreMigrate(t *testing.T) {
+	tests := []struct {
+		name   string
+		db     string
+		legacy string
+		ids    []string
+		titles map[string]string
+		// 迁移后日志的行数
+		lines int
+	}{
+		{"没有旧文件", "{\"Id\":\"1\"}\n", "", []string{"1"}, nil, 1},
+		{"导入旧文件", "", "1 2\n3", []string{"1", "2", "3"}, nil, 3},
+		{"已有的记录不覆盖", "{\"Id\":\"2\",\"Title\":\"a\"}\n", "1 2 3", []string{"1", "2", "3"}, map[string]string{"2": "a"}, 3},
+		// 上次迁移写入记录后没来得及重命名旧文件
+		{"迁移中途崩溃后再次迁移", "{\"Id\":\"1\"}\n{\"Id\":\"2\"}\n", "1 2", []string{"1", "2"}, nil, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeStoreFiles(t, test.db, test.legacy)
+			defer os.RemoveAll(dir)
+			store, err := OpenStore(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+			checkRecords(t, store, test.ids, test.titles)
+			if store.lines != test.lines {
+				t.Errorf("lines = %d, want %d", store.lines, test.lines)
+			}
+			if len(test.legacy) == 0 {
+				return
+			}
+			if _, err = os.Stat(filepath.Join(dir, legacyMemoName)); !os.IsNotExist(err) {
+				t.Errorf("旧文件没有重命名")
+			}
+			if _, err = os.Stat(filepath.Join(dir, legacyMemoName+".migrated")); err != nil {
+				t.Errorf("没有找到重命名后的旧文件: %v", err)
+			}
+		})
+	}
+}
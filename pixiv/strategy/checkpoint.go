@@ -0,0 +1,192 @@
+package strategy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pixivic/pixiv"
+	"sync"
+	"time"
+)
+
+// 断点文件目录, 位于图片根目录下
+const checkpointDir = "checkpoints"
+
+// 按时间段爬取的断点, 每爬完一页保存一次
+type Checkpoint struct {
+	KeyWord string
+	// 当前时间段的起点和终点, 终点之后的时间段都已完成
+	// 旧版本的断点没有起点, 按三个月计算
+	WindowStart string
+	WindowEnd   string
+	// 当前时间段已完成的页数
+	Page int
+	// 已完成的页中提交了但还没有下载完成的作品
+	Pending []pixiv.Illust `json:",omitempty"`
+	// 爬取条件, 仅供查看
+	SearchMode string `json:",omitempty"`
+	R18        bool   `json:",omitempty"`
+	Bookmarks  int
+	PicType    string
+	// 保存时间
+	UpdateTime time.Time
+}
+
+// 断点文件名: 转义后的关键字, 匹配方式不是默认的部分一致或爬取R-18时加上后缀
+// 不同匹配方式的搜索结果不同, 不能共用断点; 转义后的关键字中不会出现 @
+func checkpointName(p *pixiv.Pixiv, query *Query) string {
+	name := url.QueryEscape(query.String())
+	if len(p.SearchMode) > 0 && p.SearchMode != SearchTag {
+		name += "@" + p.SearchMode
+	}
+	if p.R18 {
+		name += "@r18"
+	}
+	return name
+}
+
+// 断点文件路径, name需为已转义的关键字
+func checkpointPath(p *pixiv.Pixiv, name string) string {
+	return filepath.Join(p.RootDir(), checkpointDir, name+".json")
+}
+
+// 读取断点, 不存在或损坏时返回false
+func loadCheckpoint(p *pixiv.Pixiv, name string) (*Checkpoint, bool) {
+	checkpoint := &Checkpoint{}
+	if err := readJson(checkpointPath(p, name), checkpoint); err != nil {
+		return nil, false
+	}
+	if _, err := time.ParseInLocation("2006-01-02", checkpoint.WindowEnd, time.Local); err != nil {
+		return nil, false
+	}
+	return checkpoint, true
+}
+
+// 断点对应的时间段
+func (c *Checkpoint) window() *window {
+	end, _ := time.ParseInLocation("2006-01-02", c.WindowEnd, time.Local)
+	start, err := time.ParseInLocation("2006-01-02", c.WindowStart, time.Local)
+	if err != nil || start.After(end) {
+		start = end.AddDate(0, -3, 0)
+	}
+	return &window{Start: start, End: end}
+}
+
+// 保存断点
+func (c *Checkpoint) save(p *pixiv.Pixiv, name string) error {
+	c.UpdateTime = time.Now()
+	return writeJson(checkpointPath(p, name), c)
+}
+
+// 写入json文件: 先写临时文件再重命名, 避免写到一半时进程被杀
+func writeJson(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// 读取json文件
+func readJson(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// 爬取全部完成后删除断点
+func removeCheckpoint(p *pixiv.Pixiv, name string) {
+	os.Remove(checkpointPath(p, name))
+}
+
+// 已提交但还没有下载完成的作品, 随断点保存, 继续时重新提交
+// 提交下载只是放入下载队列, 主动关闭时队列中和正在下载的作品都会被放弃
+type pendingWorks struct {
+	mutex sync.Mutex
+	works map[string]pixiv.Illust
+}
+
+func newPendingWorks() *pendingWorks {
+	return &pendingWorks{works: make(map[string]pixiv.Illust)}
+}
+
+// 记录已提交的作品
+func (w *pendingWorks) add(detail pixiv.Illust) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.works[detail.Id] = detail
+}
+
+// 是否已提交
+func (w *pendingWorks) has(id string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, ok := w.works[id]
+	return ok
+}
+
+// 还没有下载完成的作品, 已经记录到存储中的去掉
+func (w *pendingWorks) list(p *pixiv.Pixiv) []pixiv.Illust {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	list := make([]pixiv.Illust, 0, len(w.works))
+	for id, detail := range w.works {
+		if p.Store.Has(id) {
+			delete(w.works, id)
+			continue
+		}
+		list = append(list, detail)
+	}
+	return list
+}
+
+// 重新筛选并提交上次保存的作品, 分组加上baseGroup前缀, 返回提交的数量
+func (w *pendingWorks) resubmit(ctx context.Context, p *pixiv.Pixiv, saved []pixiv.Illust, baseGroup string) int {
+	count := 0
+	for _, detail := range saved {
+		if ctx.Err() != nil {
+			break
+		}
+		if p.Store.Has(detail.Id) {
+			continue
+		}
+		detail := detail
+		picDetail, flag := process(ctx, p, &detail)
+		if !flag {
+			continue
+		}
+		if len(baseGroup) > 0 {
+			picDetail.Group = baseGroup + "/" + picDetail.Group
+		}
+		if p.Submit(ctx, picDetail) {
+			w.add(detail)
+			count++
+		}
+	}
+	if count > 0 {
+		log.Println("重新提交上次没有下载完成的 ", count, " 张")
+	}
+	return count
+}
@@ -0,0 +1,115 @@
+package strategy
+
+import (
+	"log"
+	"path/filepath"
+	"pixivic/pixiv"
+	"time"
+)
+
+const (
+	// 搜索结果每页的数量
+	searchPageSize = 60
+	// 搜索结果最多能翻到的页数, 超过的结果无法获取
+	searchMaxPage = 1000
+	// 默认时间段的天数
+	defaultWindowDays = 90
+	// 结果稀疏时时间段最多扩大到的天数
+	maxWindowDays = 720
+	// 覆盖率报告目录, 位于图片根目录下
+	coverageDir = "coverage"
+)
+
+// pixiv开站时间, 更早的时间段没有作品
+var searchBegin = time.Date(2007, 9, 10, 0, 0, 0, 0, time.Local)
+
+// 搜索的时间段, 包含起止日期
+type window struct {
+	Start, End time.Time
+}
+
+// 以end为终点, 长度为days天的时间段
+func newWindow(end time.Time, days int) *window {
+	end = time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, time.Local)
+	return &window{Start: end.AddDate(0, 0, 1-days), End: end}
+}
+
+// 时间段的天数
+func (w *window) days() int {
+	return int(w.End.Sub(w.Start).Hours()/24+0.5) + 1
+}
+
+func (w *window) String() string {
+	return w.Start.Format("2006-01-02") + "至" + w.End.Format("2006-01-02")
+}
+
+// 根据当前时间段的结果数调整下一个时间段的天数:
+// 结果接近上限时缩小, 结果稀疏时扩大
+func nextWindowDays(days, total int) int {
+	reachable := searchPageSize * searchMaxPage
+	switch {
+	case total > reachable/2 && days > 1:
+		return days / 2
+	case total < reachable/8 && days < maxWindowDays:
+		days *= 2
+		if days > maxWindowDays {
+			days = maxWindowDays
+		}
+	}
+	return days
+}
+
+// 一个时间段的覆盖情况
+type WindowCoverage struct {
+	Start, End string
+	// 搜索结果总数
+	Total int
+	// 受翻页上限限制后可以获取的数量
+	Reachable int
+	// 实际获取到的数量
+	Fetched int
+	// 筛选后提交下载的数量
+	Selected int64
+}
+
+// 一个搜索条件的覆盖率报告
+type Coverage struct {
+	KeyWord    string
+	Windows    []WindowCoverage
+	UpdateTime time.Time
+}
+
+// 记录一个时间段的覆盖情况并输出日志
+func (c *Coverage) add(w *window, total, fetched int, selected int64) {
+	reachable := total
+	if reachable > searchPageSize*searchMaxPage {
+		reachable = searchPageSize * searchMaxPage
+	}
+	c.Windows = append(c.Windows, WindowCoverage{
+		Start:     w.Start.Format("2006-01-02"),
+		End:       w.End.Format("2006-01-02"),
+		Total:     total,
+		Reachable: reachable,
+		Fetched:   fetched,
+		Selected:  selected,
+	})
+	log.Println(w.String(), " 共 ", total, " 张, 可获取 ", reachable, " 张, 实际获取 ", fetched, " 张, 筛选出 ", selected, " 张")
+}
+
+// 输出汇总并保存报告到 coverage/<关键字>.json
+func (c *Coverage) report(p *pixiv.Pixiv, name string) {
+	var total, reachable, fetched int
+	var selected int64
+	for _, w := range c.Windows {
+		total += w.Total
+		reachable += w.Reachable
+		fetched += w.Fetched
+		selected += w.Selected
+	}
+	log.Println(c.KeyWord, " 覆盖率: ", len(c.Windows), " 个时间段共 ", total, " 张, 可获取 ", reachable,
+		" 张, 实际获取 ", fetched, " 张, 筛选出 ", selected, " 张")
+	c.UpdateTime = time.Now()
+	if err := writeJson(filepath.Join(p.RootDir(), coverageDir, name+".json"), c); err != nil {
+		log.Println("覆盖率报告保存失败 ", err)
+	}
+}
@@ -0,0 +1,296 @@
+package strategy
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pixivic/pixiv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 遍历顺序
+const (
+	// 广度优先, 先爬完离种子近的作品
+	OrderBFS = "bfs"
+	// 最佳优先, 先展开得分高的作品
+	OrderBest = "best"
+)
+
+// 每轮同时展开的作品数
+const graphBatch = 10
+
+// 作品得分, seedTags为所有种子作品的标签, 得分越高越先展开
+type ScoreFunc func(illust *pixiv.Illust, info *pixiv.IllustInfo, seedTags map[string]bool) float64
+
+// 默认得分: (收藏数 + 1) * (1 + 与种子相同的标签数)
+func BookmarkTagScore(illust *pixiv.Illust, info *pixiv.IllustInfo, seedTags map[string]bool) float64 {
+	overlap := 0
+	for _, tag := range illust.Tags {
+		if seedTags[tag] {
+			overlap++
+		}
+	}
+	return float64(info.BookmarkCount+1) * float64(1+overlap)
+}
+
+// 相关作品图的遍历参数
+type GraphOptions struct {
+	// 遍历顺序 bfs 或 best
+	Order string
+	// 最大深度, 种子的相关作品深度为1
+	MaxDepth int
+	// 每个作品获取的相关作品数
+	FanOut int
+	// 每次运行最多访问的作品数, 0 表示不限制
+	Budget int
+	// 最佳优先时的得分, 为空时使用 BookmarkTagScore
+	Score ScoreFunc
+}
+
+// 默认参数: 广度优先, 深度3, 每个作品100个相关作品, 每次最多访问10000个作品
+func DefaultGraphOptions() GraphOptions {
+	return GraphOptions{
+		Order:    OrderBFS,
+		MaxDepth: 3,
+		FanOut:   100,
+		Budget:   10000,
+	}
+}
+
+// 校验参数
+func (o *GraphOptions) Validate() error {
+	if o.Order != OrderBFS && o.Order != OrderBest {
+		return fmt.Errorf("遍历顺序只能为 bfs 或 best: %s", o.Order)
+	}
+	if o.MaxDepth < 1 {
+		return fmt.Errorf("最大深度必须大于0: %d", o.MaxDepth)
+	}
+	if o.FanOut < 1 {
+		return fmt.Errorf("相关作品数必须大于0: %d", o.FanOut)
+	}
+	if o.Budget < 0 {
+		return fmt.Errorf("访问作品数不能小于0: %d", o.Budget)
+	}
+	return nil
+}
+
+// 待展开的作品
+type GraphNode struct {
+	Id    string
+	Depth int
+	Score float64
+	// 加入的顺序, 相同优先级时先进先出
+	Seq int64
+}
+
+// 待展开作品的优先队列
+type frontier struct {
+	nodes []*GraphNode
+	best  bool
+}
+
+func (f *frontier) Len() int { return len(f.nodes) }
+
+func (f *frontier) Less(i, j int) bool {
+	a, b := f.nodes[i], f.nodes[j]
+	if f.best && a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if !f.best && a.Depth != b.Depth {
+		return a.Depth < b.Depth
+	}
+	return a.Seq < b.Seq
+}
+
+func (f *frontier) Swap(i, j int) { f.nodes[i], f.nodes[j] = f.nodes[j], f.nodes[i] }
+
+func (f *frontier) Push(x interface{}) { f.nodes = append(f.nodes, x.(*GraphNode)) }
+
+func (f *frontier) Pop() interface{} {
+	node := f.nodes[len(f.nodes)-1]
+	f.nodes = f.nodes[:len(f.nodes)-1]
+	return node
+}
+
+// 遍历进度, 保存在 checkpoints/related-<种子>.json
+type GraphState struct {
+	Seeds    string
+	Visited  []string
+	Frontier []*GraphNode
+	// 已提交但还没有下载完成的作品, 继续时重新提交
+	Pending []pixiv.Illust `json:",omitempty"`
+	Seq     int64
+	// 保存时间
+	UpdateTime time.Time
+}
+
+// 按参数遍历相关作品图的策略, KeyWord为逗号分隔的种子图片ID
+// 开启Resume时从上次保存的已访问集合和待展开队列继续
+func RelatedGraph(options GraphOptions) pixiv.Strategy {
+	if options.Score == nil {
+		options.Score = BookmarkTagScore
+	}
+	return pixiv.StrategyFunc(func(ctx context.Context, p *pixiv.Pixiv) error {
+		return crawlGraph(ctx, p, options)
+	})
+}
+
+// 根据输入图片Id爬取相关图片, 使用默认参数
+func PicIdStrategy(ctx context.Context, p *pixiv.Pixiv) error {
+	return RelatedGraph(DefaultGraphOptions()).Crawl(ctx, p)
+}
+
+// 有作品的相关作品获取失败时继续遍历, 最后返回错误
+func crawlGraph(ctx context.Context, p *pixiv.Pixiv, options GraphOptions) error {
+	seeds, _ := url.QueryUnescape(p.KeyWord)
+	statePath := filepath.Join(p.RootDir(), checkpointDir, "related-"+url.QueryEscape(seeds)+".json")
+	state := &GraphState{Seeds: seeds}
+	queue := &frontier{best: options.Order == OrderBest}
+	visited := make(map[string]bool)
+	if p.Resume {
+		if err := readJson(statePath, state); err != nil && !os.IsNotExist(err) {
+			log.Println("相关作品进度读取失败, 将从种子开始", err)
+		}
+		for _, id := range state.Visited {
+			visited[id] = true
+		}
+		for _, node := range state.Frontier {
+			heap.Push(queue, node)
+		}
+		if len(state.Visited) > 0 {
+			log.Println("从上次进度继续: 已访问 ", len(state.Visited), " 张, 待展开 ", queue.Len(), " 张")
+		}
+	}
+	// 上次没有下载完成的作品重新提交
+	pending := newPendingWorks()
+	pending.resubmit(ctx, p, state.Pending, "")
+	// 种子作品的标签, 用于计算得分
+	seedTags := make(map[string]bool)
+	for _, seed := range strings.Split(seeds, ",") {
+		seed = strings.TrimSpace(seed)
+		if len(seed) == 0 {
+			continue
+		}
+		if queue.best {
+			if info, err := p.IllustInfo(ctx, seed); err == nil {
+				for _, tag := range info.TagNames() {
+					seedTags[tag] = true
+				}
+			}
+		}
+		if len(state.Visited) == 0 {
+			visited[seed] = true
+			state.Seq++
+			heap.Push(queue, &GraphNode{Id: seed, Seq: state.Seq})
+		}
+	}
+
+	mutex := sync.Mutex{}
+	var count, num, failed int64
+	for queue.Len() > 0 && ctx.Err() == nil && (options.Budget == 0 || count < int64(options.Budget)) {
+		// 每轮取出若干作品并行展开
+		var batch []*GraphNode
+		for queue.Len() > 0 && len(batch) < graphBatch {
+			batch = append(batch, heap.Pop(queue).(*GraphNode))
+		}
+		// 没有展开完, 需要放回队列的作品
+		requeue := make(map[*GraphNode]bool)
+		wait := sync.WaitGroup{}
+		for _, node := range batch {
+			wait.Add(1)
+			go func(node *GraphNode) {
+				defer wait.Done()
+				related, err := getRelevanceUrls(ctx, p, node.Id, options.FanOut)
+				if err != nil && ctx.Err() == nil {
+					atomic.AddInt64(&failed, 1)
+				}
+				for _, detail := range related {
+					mutex.Lock()
+					if visited[detail.Id] {
+						mutex.Unlock()
+						continue
+					}
+					// 超出访问数量时放回队列, 下次运行继续展开
+					if options.Budget > 0 && count >= int64(options.Budget) || ctx.Err() != nil {
+						requeue[node] = true
+						mutex.Unlock()
+						return
+					}
+					visited[detail.Id] = true
+					count++
+					mutex.Unlock()
+					child := &GraphNode{Id: detail.Id, Depth: node.Depth + 1}
+					if queue.best {
+						if info, err := p.IllustInfo(ctx, detail.Id); err == nil {
+							child.Score = options.Score(&detail, info, seedTags)
+						}
+					}
+					if p.RepetitionOdds > 0 || !p.IsDownloaded(detail.Id) {
+						picDetail, flag := process(ctx, p, &detail)
+						if flag && p.Submit(ctx, picDetail) {
+							atomic.AddInt64(&num, 1)
+							pending.add(detail)
+						}
+					}
+					// 中止时可能没有筛选或提交完, 不记为已访问, 父作品已放回队列, 下次展开时重新处理
+					interrupted := ctx.Err() != nil
+					if interrupted && !pending.has(detail.Id) {
+						mutex.Lock()
+						delete(visited, detail.Id)
+						count--
+						mutex.Unlock()
+						return
+					}
+					// 达到最大深度的作品不再展开, 已提交的作品在中止时同样放入队列, 下次继续展开
+					if child.Depth < options.MaxDepth {
+						mutex.Lock()
+						state.Seq++
+						child.Seq = state.Seq
+						heap.Push(queue, child)
+						mutex.Unlock()
+					}
+					if interrupted {
+						return
+					}
+				}
+			}(node)
+		}
+		wait.Wait()
+		// 主动关闭时本轮的作品都可能没有展开完
+		for _, node := range batch {
+			if requeue[node] || ctx.Err() != nil {
+				heap.Push(queue, node)
+			}
+		}
+		state.save(p, statePath, visited, queue, pending)
+		log.Println("相关作品已访问 ", count, " 张, 待展开 ", queue.Len(), " 张, 筛选出 ", atomic.LoadInt64(&num), " 张")
+	}
+	if queue.Len() == 0 {
+		log.Println("相关作品遍历完成！")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d 张作品的相关作品获取失败", failed)
+	}
+	return nil
+}
+
+// 保存遍历进度
+func (s *GraphState) save(p *pixiv.Pixiv, path string, visited map[string]bool, queue *frontier, pending *pendingWorks) {
+	s.Visited = s.Visited[:0]
+	for id := range visited {
+		s.Visited = append(s.Visited, id)
+	}
+	s.Frontier = queue.nodes
+	s.Pending = pending.list(p)
+	s.UpdateTime = time.Now()
+	if err := writeJson(path, s); err != nil {
+		log.Println("相关作品进度保存失败 ", err)
+	}
+}
@@ -0,0 +1,292 @@
+package strategy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"pixivic/pixiv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 收藏列表每次请求的数量
+const bookmarkPageSize = 48
+
+// 未分类收藏对应的标签
+const uncategorized = "未分類"
+
+// 关注用户新作最多可以翻到的页数
+const followMaxPage = 35
+
+// 收藏列表
+type BookmarkWorks struct {
+	Body struct {
+		Works []pixiv.Illust
+		Total int
+	}
+}
+
+// 收藏标签
+type BookmarkTags struct {
+	Body struct {
+		Public  []BookmarkTag
+		Private []BookmarkTag
+	}
+}
+
+type BookmarkTag struct {
+	Tag string
+	Cnt int
+}
+
+// 关注用户的新作
+type FollowLatest struct {
+	Body struct {
+		Thumbnails struct {
+			Illust []pixiv.Illust
+		}
+	}
+}
+
+// 关注用户新作的爬取进度
+type FollowState struct {
+	// 爬取的账号, 与当前账号不同时从头爬取
+	UserId string `json:",omitempty"`
+	// 上次爬取完成时最新的作品ID
+	LastId string
+	// 上次提交下载的作品ID, 没有下载完成的下次重新爬取
+	Pending    []string `json:",omitempty"`
+	UpdateTime time.Time
+}
+
+// 爬取当前账号的收藏, 按收藏标签分组为 bookmarks/<public|private>/<标签>
+// KeyWord为 public 或 private 时只爬取公开或私密收藏, 否则全部爬取
+// 收藏是镜像, 不经过尺寸和收藏数筛选
+// 账号在爬取过程中被停用时立即停止
+func BookmarkStrategy(ctx context.Context, p *pixiv.Pixiv) error {
+	account, err := currentAccount(ctx, p)
+	if err != nil {
+		return fmt.Errorf("用户信息获取失败: %v", err)
+	}
+	rests := map[string]string{"public": "show", "private": "hide"}
+	keyword, _ := url.QueryUnescape(p.KeyWord)
+	if rest, ok := rests[strings.ToLower(keyword)]; ok {
+		rests = map[string]string{strings.ToLower(keyword): rest}
+	}
+
+	tags := &BookmarkTags{}
+	if err := account.getJson(ctx, p, "https://www.pixiv.net/ajax/user/"+account.userId+"/illusts/bookmark/tags", tags); err != nil {
+		if errors.Is(err, errAccountDisabled) {
+			return err
+		}
+		log.Println("收藏标签获取失败, 将不按标签分组", err)
+	}
+	var num int64 = 0
+	var failed []string
+	for _, name := range []string{"public", "private"} {
+		rest, ok := rests[name]
+		if !ok {
+			continue
+		}
+		folders := tags.Body.Public
+		if name == "private" {
+			folders = tags.Body.Private
+		}
+		// 标签列表中没有未分类时, 最后爬取全部收藏补齐未分类的作品
+		if !hasUncategorized(folders) {
+			folders = append(folders, BookmarkTag{})
+		}
+		for _, folder := range folders {
+			if ctx.Err() != nil {
+				break
+			}
+			group := "bookmarks/" + name
+			if len(folder.Tag) > 0 {
+				group += "/" + dirName(folder.Tag, "_")
+			}
+			count, err := crawlBookmarks(ctx, p, account, rest, folder.Tag, group)
+			num += count
+			if errors.Is(err, errAccountDisabled) {
+				log.Println("收藏共 ", num, " 张待下载")
+				return err
+			}
+			if err != nil && ctx.Err() == nil {
+				failed = append(failed, group)
+			}
+		}
+	}
+	log.Println("收藏共 ", num, " 张待下载")
+	if len(failed) > 0 {
+		return fmt.Errorf("%d 个收藏标签获取失败: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// 标签列表中是否包含未分类
+func hasUncategorized(tags []BookmarkTag) bool {
+	for _, tag := range tags {
+		if tag.Tag == uncategorized {
+			return true
+		}
+	}
+	return false
+}
+
+// 爬取一个收藏标签下的所有作品, 返回提交下载的数量, 某一页获取失败时停止并返回错误
+func crawlBookmarks(ctx context.Context, p *pixiv.Pixiv, account *userAccount, rest, tag, group string) (int64, error) {
+	var num int64 = 0
+	for offset := 0; ctx.Err() == nil; offset += bookmarkPageSize {
+		urlStr := "https://www.pixiv.net/ajax/user/" + account.userId + "/illusts/bookmarks?tag=" + url.QueryEscape(tag) +
+			"&offset=" + strconv.Itoa(offset) + "&limit=" + strconv.Itoa(bookmarkPageSize) + "&rest=" + rest
+		works := &BookmarkWorks{}
+		if err := account.getJson(ctx, p, urlStr, works); err != nil {
+			log.Println(group, " 收藏获取失败", err)
+			return num, err
+		}
+		for _, detail := range works.Body.Works {
+			p.EmitDiscovered(&detail)
+			// 已删除或不可见的作品没有原图地址
+			if !strings.Contains(detail.Url, "/img/") {
+				p.EmitFiltered(&detail, "作品已删除或不可见")
+				continue
+			}
+			if p.RepetitionOdds == 0 && p.IsDownloaded(detail.Id) {
+				continue
+			}
+			picDetail := newPicDetail(&detail)
+			picDetail.Group = group
+			if p.Submit(ctx, picDetail) {
+				num++
+			}
+		}
+		if len(works.Body.Works) < bookmarkPageSize || offset+bookmarkPageSize >= works.Body.Total {
+			break
+		}
+	}
+	log.Println(group, " 共 ", num, " 张待下载")
+	return num, nil
+}
+
+// 增量爬取关注用户的新作: 从最新的作品向前翻页, 遇到上次爬取完成时最新的作品为止
+// 作品经过筛选后分组为 follow/<作者>/<类型>
+// 某一页获取失败或账号被停用时不更新进度并返回错误
+func FollowStrategy(ctx context.Context, p *pixiv.Pixiv) error {
+	account, err := currentAccount(ctx, p)
+	if err != nil {
+		return fmt.Errorf("用户信息获取失败: %v", err)
+	}
+	statePath := filepath.Join(p.RootDir(), checkpointDir, "follow.json")
+	state := &FollowState{}
+	if err := readJson(statePath, state); err != nil && !os.IsNotExist(err) {
+		log.Println("关注新作进度读取失败, 将从头爬取", err)
+	}
+	// 进度属于其他账号时关注列表不同, 从头爬取
+	if len(state.UserId) > 0 && state.UserId != account.userId {
+		log.Println("关注新作进度属于账号 ", state.UserId, ", 当前账号为 ", account.userId, ", 将从头爬取")
+		state = &FollowState{}
+	}
+	state.UserId = account.userId
+	// 上次提交后没有下载完成的作品, 向前翻页到它为止
+	cursor := state.LastId
+	for _, id := range state.Pending {
+		if p.Store.Has(id) {
+			continue
+		}
+		if before := previousId(id); len(cursor) == 0 || newerId(cursor, before) {
+			cursor = before
+		}
+	}
+	latestId := ""
+	var num int64 = 0
+	var pending []string
+	mutex := sync.Mutex{}
+	complete := false
+	var failure error
+	for page := 1; page <= followMaxPage && ctx.Err() == nil; page++ {
+		latest := &FollowLatest{}
+		if err := account.getJson(ctx, p, "https://www.pixiv.net/ajax/follow_latest/illust?mode=all&p="+strconv.Itoa(page), latest); err != nil {
+			log.Println("关注新作第 ", page, " 页获取失败", err)
+			if ctx.Err() == nil {
+				failure = fmt.Errorf("关注新作第 %d 页获取失败: %v", page, err)
+			}
+			break
+		}
+		illusts := latest.Body.Thumbnails.Illust
+		if len(illusts) == 0 {
+			complete = true
+			break
+		}
+		reached := false
+		countdown := sync.WaitGroup{}
+		for _, detail := range illusts {
+			if len(latestId) == 0 || newerId(detail.Id, latestId) {
+				latestId = detail.Id
+			}
+			if len(cursor) > 0 && !newerId(detail.Id, cursor) {
+				reached = true
+				continue
+			}
+			if p.RepetitionOdds == 0 && p.IsDownloaded(detail.Id) {
+				continue
+			}
+			countdown.Add(1)
+			go func(detail pixiv.Illust) {
+				defer countdown.Done()
+				picDetail, flag := process(ctx, p, &detail)
+				if flag {
+					picDetail.Group = "follow/" + dirName(detail.UserName, detail.UserId) + "/" + picDetail.Group
+					atomic.AddInt64(&num, 1)
+					if p.Submit(ctx, picDetail) {
+						mutex.Lock()
+						pending = append(pending, detail.Id)
+						mutex.Unlock()
+					}
+				}
+			}(detail)
+		}
+		countdown.Wait()
+		log.Println("关注新作第 ", page, " 页待选 ", len(illusts), " 张")
+		if reached || page == followMaxPage {
+			complete = true
+			break
+		}
+	}
+	log.Println("关注新作共筛选出 ", atomic.LoadInt64(&num), " 张")
+
+	// 中途停止时不更新进度, 下次从头补齐
+	if complete && ctx.Err() == nil && len(latestId) > 0 {
+		if newerId(latestId, state.LastId) {
+			state.LastId = latestId
+		}
+		state.Pending = pending
+		state.UpdateTime = time.Now()
+		if err := writeJson(statePath, state); err != nil {
+			log.Println("关注新作进度保存失败", err)
+		}
+	}
+	return failure
+}
+
+// 比作品ID小1的ID, 作为翻页终点时包含该作品
+func previousId(id string) string {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(n-1, 10)
+}
+
+// 作品ID a 是否比 b 新
+func newerId(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
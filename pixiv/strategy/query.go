@@ -0,0 +1,146 @@
+package strategy
+
+import (
+	"net/url"
+	"pixivic/pixiv"
+	"strconv"
+	"strings"
+)
+
+// 标签匹配方式
+const (
+	// 标签完全一致
+	SearchTagFull = "s_tag_full"
+	// 标签部分一致
+	SearchTag = "s_tag"
+	// 标题和说明文字
+	SearchText = "s_tc"
+)
+
+// 解析匹配方式, 支持 full, partial, text 简写
+func ParseSearchMode(s string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "full", SearchTagFull:
+		return SearchTagFull, true
+	case "", "partial", SearchTag:
+		return SearchTag, true
+	case "text", SearchText:
+		return SearchText, true
+	}
+	return "", false
+}
+
+// 搜索条件: Include 的每一组内为 OR 关系, 组之间为 AND 关系, 并排除 Exclude 中的标签
+type Query struct {
+	Include [][]string
+	Exclude []string
+}
+
+// 解析以分号分隔的多个搜索条件, 空字符串解析为一个不限关键字的条件
+func ParseQueries(s string) []*Query {
+	var queries []*Query
+	for _, item := range strings.Split(s, ";") {
+		query := ParseQuery(item)
+		if query.Empty() {
+			continue
+		}
+		queries = append(queries, query)
+	}
+	if len(queries) == 0 {
+		queries = append(queries, &Query{})
+	}
+	return queries
+}
+
+// 解析搜索条件, 以空格分隔:
+// 风景 -R-18 (夜景 OR 星空) 或 风景 -R-18 夜景|星空
+// 排除的标签总是作用于整个条件, 不会打断 OR: "A -B OR C" 解析为 (A OR C) -B
+func ParseQuery(s string) *Query {
+	query := &Query{}
+	var group []string
+	// 上一个词是 OR 或在括号内时, 下一个词加入当前组
+	or, inParen := false, false
+	for _, token := range strings.Fields(s) {
+		if strings.ToUpper(token) == "OR" {
+			or = len(group) > 0
+			continue
+		}
+		opening := strings.HasPrefix(token, "(")
+		closing := strings.HasSuffix(token, ")")
+		token = strings.Trim(token, "()")
+		if len(token) > 1 && strings.HasPrefix(token, "-") && !or && !inParen && !opening {
+			query.Exclude = append(query.Exclude, token[1:])
+		} else if len(token) > 0 {
+			var tags []string
+			for _, tag := range strings.Split(token, "|") {
+				if len(tag) > 0 {
+					tags = append(tags, tag)
+				}
+			}
+			if (or || inParen) && !opening {
+				group = append(group, tags...)
+			} else {
+				if len(group) > 0 {
+					query.Include = append(query.Include, group)
+				}
+				group = tags
+			}
+		}
+		inParen = (inParen || opening) && !closing
+		or = false
+	}
+	if len(group) > 0 {
+		query.Include = append(query.Include, group)
+	}
+	return query
+}
+
+// 是否没有任何条件
+func (q *Query) Empty() bool {
+	return len(q.Include) == 0 && len(q.Exclude) == 0
+}
+
+// 生成pixiv的搜索词, 如 (夜景 OR 星空) 风景 -R-18
+func (q *Query) String() string {
+	var words []string
+	for _, group := range q.Include {
+		if len(group) == 1 {
+			words = append(words, group[0])
+		} else {
+			words = append(words, "("+strings.Join(group, " OR ")+")")
+		}
+	}
+	for _, tag := range q.Exclude {
+		words = append(words, "-"+tag)
+	}
+	return strings.Join(words, " ")
+}
+
+// 保存目录名, 替换路径分隔符和不能用于文件名的字符
+func (q *Query) Group() string {
+	return dirName(q.String(), "")
+}
+
+// 搜索接口地址, w不为空时限定作品的发布时间
+func (q *Query) searchUrl(p *pixiv.Pixiv, page int, w *window) string {
+	word := q.String()
+	// 按收藏数区间的标签缩小范围, 按标题搜索时无效
+	if p.SearchMode != SearchText {
+		word = strings.TrimSpace(word + " " + strconv.Itoa(getMinBookMark(p.Bookmarks)) + "users入り")
+	}
+	mode := p.SearchMode
+	if len(mode) == 0 {
+		mode = SearchTag
+	}
+	urlStr := "https://www.pixiv.net/ajax/search/illustrations/" + url.PathEscape(word) +
+		"?word=" + url.QueryEscape(word) + "&order=date_d&mode=all" +
+		"&p=" + strconv.Itoa(page) + "&s_mode=" + mode + "&type=illust"
+	if !strings.Contains(p.PicType, "s") {
+		urlStr += "&wlt=1000&hlt=1000"
+	}
+	if w != nil {
+		urlStr += "&scd=" + w.Start.Format("2006-01-02") +
+			"&ecd=" + w.End.Format("2006-01-02")
+	}
+	return urlStr
+}
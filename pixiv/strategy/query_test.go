@@ -0,0 +1,75 @@
+package strategy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		input   string
+		include [][]string
+		exclude []string
+	}{
+		{"", nil, nil},
+		{"风景", [][]string{{"风景"}}, nil},
+		{"风景 -R-18 (夜景 OR 星空)", [][]string{{"风景"}, {"夜景", "星空"}}, []string{"R-18"}},
+		{"风景 -R-18 夜景|星空", [][]string{{"风景"}, {"夜景", "星空"}}, []string{"R-18"}},
+		{"A or B", [][]string{{"A", "B"}}, nil},
+		{"OR A", [][]string{{"A"}}, nil},
+		{"(A -B)", [][]string{{"A", "-B"}}, nil},
+		// 排除的标签不打断 OR
+		{"A -B OR C", [][]string{{"A", "C"}}, []string{"B"}},
+		{"-", [][]string{{"-"}}, nil},
+	}
+	for _, test := range tests {
+		query := ParseQuery(test.input)
+		if !reflect.DeepEqual(query.Include, test.include) || !reflect.DeepEqual(query.Exclude, test.exclude) {
+			t.Errorf("ParseQuery(%q) = %v -%v, want %v -%v", test.input, query.Include, query.Exclude, test.include, test.exclude)
+		}
+	}
+}
+
+func TestQueryString(t *testing.T) {
+	tests := []struct {
+		input string
+		word  string
+		group string
+	}{
+		{"风景 -R-18 夜景|星空", "风景 (夜景 OR 星空) -R-18", "风景 (夜景 OR 星空) -R-18"},
+		{"A -B OR C", "(A OR C) -B", "(A OR C) -B"},
+		{"Fate/GO", "Fate/GO", "Fate_GO"},
+		{"..", "..", ""},
+		{"what?", "what?", "what_"},
+	}
+	for _, test := range tests {
+		query := ParseQuery(test.input)
+		if word := query.String(); word != test.word {
+			t.Errorf("ParseQuery(%q).String() = %q, want %q", test.input, word, test.word)
+		}
+		if group := query.Group(); group != test.group {
+			t.Errorf("ParseQuery(%q).Group() = %q, want %q", test.input, group, test.group)
+		}
+	}
+}
+
+func TestParseQueries(t *testing.T) {
+	tests := []struct {
+		input string
+		words []string
+	}{
+		{"", []string{""}},
+		{" ; ;", []string{""}},
+		{"风景", []string{"风景"}},
+		{"风景; 夜景|星空 -R-18 ;", []string{"风景", "(夜景 OR 星空) -R-18"}},
+	}
+	for _, test := range tests {
+		var words []string
+		for _, query := range ParseQueries(test.input) {
+			words = append(words, query.String())
+		}
+		if !reflect.DeepEqual(words, test.words) {
+			t.Errorf("ParseQueries(%q) = %q, want %q", test.input, words, test.words)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package strategy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"pixivic/pixiv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 排行榜模式, 值为是否是R-18排行榜
+var RankingModes = map[string]bool{
+	"daily":      false,
+	"weekly":     false,
+	"monthly":    false,
+	"rookie":     false,
+	"original":   false,
+	"male":       false,
+	"female":     false,
+	"daily_r18":  true,
+	"weekly_r18": true,
+	"male_r18":   true,
+	"female_r18": true,
+	"r18g":       true,
+}
+
+// 排行榜接口返回的一页数据, 每页50个作品
+type RankingPage struct {
+	Contents []RankingItem
+	Mode     string
+	Page     int
+	// 下一页页码, 没有下一页时为false
+	Next json.RawMessage
+	Date string
+	// 错误信息, 如日期超出范围
+	Error string
+}
+
+// 是否还有下一页
+func (r *RankingPage) HasNext() bool {
+	return len(r.Next) > 0 && string(r.Next) != "false"
+}
+
+// 排行榜中的作品
+type RankingItem struct {
+	IllustId int64 `json:"illust_id"`
+	Title    string
+	Url      string
+	Tags     []string
+	UserId   int64  `json:"user_id"`
+	UserName string `json:"user_name"`
+	Width    int
+	Height   int
+	Rank     int
+	Date     string
+	// 页数和作品类型返回的是字符串
+	PageCount  string `json:"illust_page_count"`
+	IllustType string `json:"illust_type"`
+}
+
+// 转换为通用的作品信息
+func (r *RankingItem) Illust() pixiv.Illust {
+	pageCount, _ := strconv.Atoi(r.PageCount)
+	illustType, _ := strconv.Atoi(r.IllustType)
+	return pixiv.Illust{
+		Id:         strconv.FormatInt(r.IllustId, 10),
+		Title:      r.Title,
+		UserId:     strconv.FormatInt(r.UserId, 10),
+		UserName:   r.UserName,
+		Url:        r.Url,
+		Tags:       r.Tags,
+		CreateDate: r.Date,
+		Width:      r.Width,
+		Height:     r.Height,
+		PageCount:  pageCount,
+		IllustType: illustType,
+	}
+}
+
+// 爬取排行榜, KeyWord为排行榜模式, 从EndTime向前爬取到StartTime(为空时只爬EndTime当天)
+// 分组为 ranking/<模式>/<日期>
+// 某一期获取失败时继续爬取之前的排行榜, 最后返回失败的期数
+func RankingStrategy(ctx context.Context, p *pixiv.Pixiv) error {
+	mode := strings.ToLower(p.KeyWord)
+	if len(mode) == 0 {
+		mode = "daily"
+	}
+	r18, ok := RankingModes[mode]
+	if !ok {
+		return errors.New("未知的排行榜模式: " + mode)
+	}
+	if r18 && !p.R18 {
+		return errors.New("R-18排行榜需要开启R18: " + mode)
+	}
+
+	// 排行榜在第二天才会发布, 终点最晚为昨天
+	yesterday := time.Now().AddDate(0, 0, -1)
+	end := yesterday
+	if p.EndTime != nil && p.EndTime.Before(yesterday) {
+		end = *p.EndTime
+	}
+	start := end
+	if p.StartTime != nil && p.StartTime.Before(end) {
+		start = *p.StartTime
+	}
+	start = time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local)
+
+	var num int64 = 0
+	var failed []string
+	for date := end; !date.Before(start); date = previousRanking(mode, date) {
+		if ctx.Err() != nil {
+			break
+		}
+		group := "ranking/" + mode + "/" + date.Format("2006-01-02")
+		count, err := crawlRanking(ctx, p, mode, date, group)
+		if err != nil && ctx.Err() == nil {
+			failed = append(failed, date.Format("2006-01-02"))
+		}
+		log.Println(group, " 筛选出 ", count, " 张")
+		num += count
+	}
+	log.Println("排行榜 ", mode, " 共筛选出 ", num, " 张")
+	if len(failed) > 0 {
+		return fmt.Errorf("排行榜 %s 有 %d 期获取失败: %s", mode, len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// 上一期排行榜的日期, 周榜(包括 r18g)和月榜按周期跳过
+func previousRanking(mode string, date time.Time) time.Time {
+	switch {
+	case strings.HasPrefix(mode, "weekly"), mode == "r18g":
+		return date.AddDate(0, 0, -7)
+	case mode == "monthly":
+		return date.AddDate(0, -1, 0)
+	default:
+		return date.AddDate(0, 0, -1)
+	}
+}
+
+// 爬取某一天排行榜的所有页, 返回筛选出的数量, 某一页获取失败时停止并返回错误
+func crawlRanking(ctx context.Context, p *pixiv.Pixiv, mode string, date time.Time, group string) (int64, error) {
+	var num int64 = 0
+	for page := 1; ctx.Err() == nil; page++ {
+		urlStr := fmt.Sprintf("https://www.pixiv.net/ranking.php?mode=%s&date=%s&p=%d&format=json",
+			mode, date.Format("20060102"), page)
+		ranking := &RankingPage{}
+		if err := getJson(ctx, p, urlStr, ranking); err != nil {
+			log.Println(group, " 第 ", page, " 页获取失败 ", err)
+			return atomic.LoadInt64(&num), err
+		}
+		if len(ranking.Error) > 0 {
+			log.Println(group, " 获取失败 ", ranking.Error)
+			return atomic.LoadInt64(&num), errors.New(ranking.Error)
+		}
+		// 每页解析是否爬取并行
+		countdown := sync.WaitGroup{}
+		for _, item := range ranking.Contents {
+			detail := item.Illust()
+			// 不爬已经爬过的
+			if p.RepetitionOdds == 0 && p.IsDownloaded(detail.Id) {
+				continue
+			}
+			countdown.Add(1)
+			go func(detail pixiv.Illust) {
+				defer countdown.Done()
+				picDetail, flag := process(ctx, p, &detail)
+				if flag {
+					picDetail.Group = group + "/" + picDetail.Group
+					atomic.AddInt64(&num, 1)
+					p.Submit(ctx, picDetail)
+				}
+			}(detail)
+		}
+		countdown.Wait()
+		if !ranking.HasNext() {
+			break
+		}
+	}
+	return atomic.LoadInt64(&num), nil
+}
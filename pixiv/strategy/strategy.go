@@ -1,9 +1,10 @@
 package strategy
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -15,72 +16,88 @@ import (
 	"time"
 )
 
-// 根据输入关键字获取图片id
-func KeywordStrategy(p *pixiv.Pixiv) {
-	baseGroup, _ := url.QueryUnescape(p.KeyWord)
-	keyword := p.KeyWord +
-		"%20" + strconv.Itoa(getMinBookMark(p.Bookmarks)) +
-		url.QueryEscape("users入り")
+// 可直接用于 pixiv.WithStrategy 的策略
+var (
+	// 按时间段搜索关键字, 对应 KeywordStrategy0
+	Keyword = pixiv.StrategyFunc(KeywordStrategy0)
+	// 根据图片ID爬取相关图片
+	Related = RelatedGraph(DefaultGraphOptions())
+	// 根据作者ID爬取其所有图片
+	Author = pixiv.StrategyFunc(AuthorStrategy)
+	// 按日期范围爬取排行榜
+	Ranking = pixiv.StrategyFunc(RankingStrategy)
+	// 爬取当前账号的收藏
+	Bookmarks = pixiv.StrategyFunc(BookmarkStrategy)
+	// 增量爬取关注用户的新作
+	Follow = pixiv.StrategyFunc(FollowStrategy)
+)
+
+// 根据输入关键字获取图片id, 多个搜索条件以分号分隔, 依次爬取
+// 某个条件失败时继续爬取之后的条件, 最后返回失败的条件
+func KeywordStrategy(ctx context.Context, p *pixiv.Pixiv) error {
+	keyword, _ := url.QueryUnescape(p.KeyWord)
+	var failed []string
+	for _, query := range ParseQueries(keyword) {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := keywordQuery(ctx, p, query); err != nil {
+			log.Println(query.String(), " 爬取失败 ", err)
+			failed = append(failed, query.String())
+		}
+	}
+	return queriesError(failed)
+}
 
-	wltHlt := "&wlt=1000&hlt=1000"
-	if strings.Contains(p.PicType, "s") {
-		wltHlt = ""
+// 爬取失败的搜索条件
+func queriesError(failed []string) error {
+	if len(failed) == 0 {
+		return nil
 	}
+	return fmt.Errorf("%d 个搜索条件爬取失败: %s", len(failed), strings.Join(failed, "; "))
+}
+
+// 不分时间段爬取一个搜索条件
+// 第一页获取失败时返回错误, 之后的页失败时跳过
+func keywordQuery(ctx context.Context, p *pixiv.Pixiv, query *Query) error {
+	baseGroup := query.Group()
 	total := 0
-	retryTime := 0
 	for i := 1; ; i++ {
-		header := &http.Header{}
-		header.Add("user-agent", pixiv.GetRandomUserAgent())
-		header.Add("cookie", p.Cookie)
-		nowUrl, _ := url.Parse("https://www.pixiv.net/ajax/search/illustrations/" +
-			keyword + "?word=" + keyword + "&order=date_d&mode=all" +
-			"&p=" + strconv.Itoa(i) + "&s_mode=s_tag&type=illust" + wltHlt)
-		request := &http.Request{
-			Method: "GET",
-			URL:    nowUrl,
-			Header: *header,
-		}
-		resp, err := p.DoRequest(request)
-		if err != nil && retryTime < 10 {
-			log.Println(err)
-			retryTime++
-			i--
-			time.Sleep(time.Millisecond * 500)
-			continue
+		details, err := doRequest(ctx, p, query, i, nil)
+		// 还有结果却没有数据时按重试策略重试, 超出次数后继续下一页
+		for attempt := 1; err == nil && len(details.Body.Illust.Data) == 0 && 60*(i-1) < details.Body.Illust.Total; attempt++ {
+			if !p.RetryWait(ctx, pixiv.RetrySearch, attempt, "第 "+strconv.Itoa(i)+" 页获取0条数据") {
+				break
+			}
+			details, err = doRequest(ctx, p, query, i, nil)
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil && i == 1 {
+			return err
 		}
-
-		var details = &pixiv.UrlDetail{}
-		json.NewDecoder(resp.Body).Decode(details)
 		if i == 1 {
 			total = details.Body.Illust.Total
 			log.Println("共 ", total, "张待选, ", total/60, " 页待爬取")
 		}
-		resp.Body.Close()
-		if len(details.Body.Illust.Data) == 0 && retryTime < 10 {
-			retryTime++
-			log.Println("第 ", i, "页获取0条数据，正在重试"+strconv.Itoa(retryTime)+"...")
-			i--
-			time.Sleep(time.Millisecond * 500)
-			continue
-		}
-		retryTime = 0
 		log.Println("第 ", i, "页待选 ", len(details.Body.Illust.Data), " 张")
 		num := 0
 		// 每页解析是否爬取并行
 		countdown := sync.WaitGroup{}
 		for _, detail := range details.Body.Illust.Data {
 			// 不爬已经爬过的
-			if p.RepetitionOdds == 0 && p.Memo[detail.Id] {
+			if p.RepetitionOdds == 0 && p.IsDownloaded(detail.Id) {
 				continue
 			}
 			// 正在执行任务计数
 			countdown.Add(1)
 			go func(detail pixiv.Illust) {
-				picDetail, flag := process(p, &detail, true)
-				if flag && atomic.LoadInt32(&p.IsCancel) == 0 {
+				picDetail, flag := process(ctx, p, &detail)
+				if flag {
 					picDetail.Group = baseGroup + "/" + picDetail.Group
 					num++
-					p.PicChan <- picDetail
+					p.Submit(ctx, picDetail)
 				}
 				countdown.Done()
 			}(detail)
@@ -89,291 +106,419 @@ func KeywordStrategy(p *pixiv.Pixiv) {
 		countdown.Wait()
 		log.Println("第 ", i, "页筛选出 ", num, " 张")
 		if 60*i > total {
-			log.Println("关键字爬取搜索完成！")
+			log.Println(baseGroup, " 关键字爬取搜索完成！")
 			break
 		}
-		if atomic.LoadInt32(&p.IsCancel) != 0 {
+		if ctx.Err() != nil {
 			break
 		}
 	}
+	return nil
 }
 
-// 根据输入关键字获取图片id 新版本
-func KeywordStrategy0(p *pixiv.Pixiv) {
-	nowTime := *p.EndTime
-	baseGroup, _ := url.QueryUnescape(p.KeyWord)
-	for nowTime.Year() > 2008 {
-		// 时间段
-		timeQuantum := nowTime.AddDate(0, -3, 0).Format("2006-01-02") + "至" +
-			nowTime.Format("2006-01-02")
+// 根据输入关键字获取图片id 新版本, 多个搜索条件以分号分隔, 每个条件有各自的目录和断点
+// 某个条件失败时继续爬取之后的条件, 最后返回失败的条件
+func KeywordStrategy0(ctx context.Context, p *pixiv.Pixiv) error {
+	keyword, _ := url.QueryUnescape(p.KeyWord)
+	var failed []string
+	for _, query := range ParseQueries(keyword) {
+		if ctx.Err() != nil {
+			break
+		}
+		if err := keywordQuery0(ctx, p, query); err != nil {
+			log.Println(query.String(), " 爬取失败 ", err)
+			failed = append(failed, query.String())
+		}
+	}
+	return queriesError(failed)
+}
+
+// 按时间段爬取一个搜索条件: 结果超过翻页上限时将时间段对半拆分, 结果稀疏时扩大时间段
+// 时间段第一页获取失败时保留断点并返回错误, 其他页失败时跳过, 完成时有跳过的页也返回错误
+func keywordQuery0(ctx context.Context, p *pixiv.Pixiv, query *Query) error {
+	baseGroup := query.Group()
+	name := checkpointName(p, query)
+	checkpoint := &Checkpoint{
+		KeyWord:    query.String(),
+		SearchMode: p.SearchMode,
+		R18:        p.R18,
+		Bookmarks:  p.Bookmarks,
+		PicType:    p.PicType,
+	}
+	coverage := &Coverage{KeyWord: query.String()}
+	current := newWindow(*p.EndTime, defaultWindowDays)
+	// 从断点继续, 跳过已经完成的时间段和页, 重新提交其中没有下载完成的作品
+	startPage := 1
+	pending := newPendingWorks()
+	if p.Resume {
+		if saved, ok := loadCheckpoint(p, name); ok {
+			current = saved.window()
+			startPage = saved.Page + 1
+			log.Println("从断点继续: ", current.String(), " 第 ", startPage, " 页")
+			pending.resubmit(ctx, p, saved.Pending, baseGroup)
+		}
+	}
+	save := func() {
+		checkpoint.Pending = pending.list(p)
+		if err := checkpoint.save(p, name); err != nil {
+			log.Println("断点保存失败 ", err)
+		}
+	}
+	reachable := searchPageSize * searchMaxPage
+	skipped := 0
+	for !current.End.Before(searchBegin) {
+		checkpoint.WindowStart = current.Start.Format("2006-01-02")
+		checkpoint.WindowEnd = current.End.Format("2006-01-02")
 		// 获取当前时间段第一页
-		firstPage := doRequest(p, 1, 0, &nowTime)
+		firstPage, err := doRequest(ctx, p, query, 1, current)
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			coverage.report(p, name)
+			return fmt.Errorf("%s 获取失败: %v", current.String(), err)
+		}
 		total := firstPage.Body.Illust.Total
-		log.Println(timeQuantum+" 共 ", total, "张待选, ", total/60, " 页待爬取")
+		// 超过翻页上限的结果无法获取, 拆分时间段后重新获取, 从断点继续时不拆分
+		if total > reachable && current.days() > 1 && startPage == 1 {
+			log.Println(current.String(), " 共 ", total, " 张, 超过可获取的 ", reachable, " 张, 拆分时间段")
+			current = newWindow(current.End, current.days()/2)
+			continue
+		}
+		pages := (total + searchPageSize - 1) / searchPageSize
+		if pages > searchMaxPage {
+			pages = searchMaxPage
+		}
+		log.Println(current.String()+" 共 ", total, "张待选, ", pages, " 页待爬取")
 		// 每页解析是否爬取并行
 		countdown := sync.WaitGroup{}
-		var num int64 = 1
-		go func() {
+		var num int64 = 0
+		fetched := 0
+		windowDone := make(chan struct{})
+		go func(timeQuantum string) {
+			ticker := time.NewTicker(time.Second * 3)
+			defer ticker.Stop()
 			for {
-				time.Sleep(time.Second * 3)
-				log.Println(timeQuantum+" 共筛选出 ", num, " 张")
+				select {
+				case <-ticker.C:
+					log.Println(timeQuantum+" 共筛选出 ", atomic.LoadInt64(&num), " 张")
+				case <-windowDone:
+					return
+				}
 			}
-		}()
-		for i := 1; i <= total/60; i++ {
-			details := doRequest(p, i, 0, &nowTime)
+		}(current.String())
+		for i := startPage; i <= pages; i++ {
+			details := firstPage
+			if i > 1 {
+				if details, err = doRequest(ctx, p, query, i, current); err != nil && ctx.Err() == nil {
+					skipped++
+				}
+			}
+			fetched += len(details.Body.Illust.Data)
 			for _, detail := range details.Body.Illust.Data {
 				// 不爬已经爬过的
-				if p.RepetitionOdds == 0 && p.Memo[detail.Id] {
+				if p.RepetitionOdds == 0 && p.IsDownloaded(detail.Id) {
 					continue
 				}
 				// 正在执行任务计数
 				countdown.Add(1)
 				go func(detail pixiv.Illust) {
-					picDetail, flag := process(p, &detail, true)
-					if flag && atomic.LoadInt32(&p.IsCancel) == 0 {
+					picDetail, flag := process(ctx, p, &detail)
+					if flag {
 						picDetail.Group = baseGroup + "/" + picDetail.Group
 						atomic.AddInt64(&num, 1)
-						p.PicChan <- picDetail
+						if p.Submit(ctx, picDetail) {
+							pending.add(detail)
+						}
 					}
 					countdown.Done()
 				}(detail)
 			}
+			// 当前页全部筛选完成后记录断点, 主动关闭时当前页可能未完整提交, 不记录
+			countdown.Wait()
+			if ctx.Err() != nil {
+				break
+			}
+			checkpoint.Page = i
+			save()
 		}
+		// 等待任务执行完成
+		countdown.Wait()
+		close(windowDone)
+		coverage.add(current, total, fetched, atomic.LoadInt64(&num))
 		// 如果主动关闭，则退出
-		if atomic.LoadInt32(&p.IsCancel) != 0 {
+		if ctx.Err() != nil {
 			break
 		}
-		// 等待任务执行完成
-		countdown.Wait()
-		// 当前时间递减三个月
-		nowTime = nowTime.AddDate(0, -3, 0)
+		// 向前移动到下一个时间段, 并根据结果数调整长度
+		current = newWindow(current.Start.AddDate(0, 0, -1), nextWindowDays(current.days(), total))
+		startPage = 1
+		checkpoint.WindowStart = current.Start.Format("2006-01-02")
+		checkpoint.WindowEnd = current.End.Format("2006-01-02")
+		checkpoint.Page = 0
+		save()
+	}
+	coverage.report(p, name)
+	if ctx.Err() == nil {
+		// 还有作品在下载时保留断点, 下次继续时只重新提交没有下载完成的作品
+		if checkpoint.Pending = pending.list(p); len(checkpoint.Pending) == 0 {
+			removeCheckpoint(p, name)
+		} else if err := checkpoint.save(p, name); err != nil {
+			log.Println("断点保存失败 ", err)
+		}
+		log.Println(baseGroup, " 关键字爬取搜索完成！")
+		if skipped > 0 {
+			return fmt.Errorf("%d 页获取失败, 已跳过", skipped)
+		}
 	}
+	return nil
 }
 
-func doRequest(p *pixiv.Pixiv, page int, retryTime int, endTime *time.Time) *pixiv.UrlDetail {
-	keyword := p.KeyWord +
-		"%20" + strconv.Itoa(getMinBookMark(p.Bookmarks)) +
-		url.QueryEscape("users入り")
-
-	wltHlt := "&wlt=1000&hlt=1000"
-	if strings.Contains(p.PicType, "s") {
-		wltHlt = ""
-	}
-	header := &http.Header{}
-	header.Add("user-agent", pixiv.GetRandomUserAgent())
-	header.Add("cookie", p.Cookie)
-	urlStr := "https://www.pixiv.net/ajax/search/illustrations/" +
-		keyword + "?word=" + keyword + "&order=date_d&mode=all" +
-		"&p=" + strconv.Itoa(page) + "&s_mode=s_tag&type=illust" + wltHlt
-	if endTime != nil {
-		urlStr += "&scd=" + endTime.AddDate(0, -3, 0).Format("2006-01-02") +
-			"&ecd=" + endTime.Format("2006-01-02")
-	}
-	nowUrl, _ := url.Parse(urlStr)
-	request := &http.Request{
-		Method: "GET",
-		URL:    nowUrl,
-		Header: *header,
-	}
-	var details = &pixiv.UrlDetail{}
-	resp, err := p.DoRequest(request)
-	// 失败重试10次
-	if err != nil && retryTime < 10 {
-		log.Println(err)
-		details = doRequest(p, page, retryTime+1, endTime)
-		time.Sleep(time.Millisecond * 500)
-	} else {
-		json.NewDecoder(resp.Body).Decode(details)
-		if details.Body.Illust.Total == 0 {
-			details = doRequest(p, page, retryTime+1, endTime)
+// 获取一页搜索结果, 请求失败时已由 DoRequest 重试, 接口报错时按重试策略重试, 结果为空是正常的
+// 还有结果却返回空页时报告给账号池, 同一账号多次出现时停用; 失败或主动关闭时返回空结果和错误
+func doRequest(ctx context.Context, p *pixiv.Pixiv, query *Query, page int, w *window) (*pixiv.UrlDetail, error) {
+	searchUrl := query.searchUrl(p, page, w)
+	for attempt := 1; ; attempt++ {
+		details := &pixiv.UrlDetail{}
+		resp, err := fetchJson(ctx, p, pixiv.RetrySearch, "", searchUrl, details)
+		if err != nil {
+			log.Println("第 ", page, " 页获取失败 ", err)
+			return &pixiv.UrlDetail{}, err
+		}
+		if !details.Error {
+			reason := ""
+			if len(details.Body.Illust.Data) == 0 && 60*(page-1) < details.Body.Illust.Total {
+				reason = "搜索结果为空"
+			}
+			p.ReportAccount(resp, reason)
+			return details, nil
+		}
+		if !p.RetryWait(ctx, pixiv.RetrySearch, attempt, "第 "+strconv.Itoa(page)+" 页接口报错") {
+			log.Println("第 ", page, " 页获取失败 接口报错")
+			return &pixiv.UrlDetail{}, errors.New("第 " + strconv.Itoa(page) + " 页接口报错")
 		}
 	}
-	resp.Body.Close()
-	return details
 }
 
-// 根据输入图片Id爬取相关图片
-func PicIdStrategy(p *pixiv.Pixiv) {
-	wait := sync.WaitGroup{}
-	imgIds, _ := url.QueryUnescape(p.KeyWord)
-	mutex := p.Mutex
-	complete := make(map[string]bool)
-	for _, imgId := range strings.Split(imgIds, ",") {
-		for _, detail := range getRelevanceUrls(p, imgId, 100, 3) {
-			mutex.Lock()
-			if !complete[detail.Id] && (p.RepetitionOdds > 0 || !p.Memo[detail.Id]) {
-				complete[detail.Id] = true
-				mutex.Unlock()
-				if atomic.LoadInt32(&p.IsCancel) == 0 {
-					picDetail, flag := process(p, &detail, true)
-					if flag && atomic.LoadInt32(&p.IsCancel) == 0 {
-						p.PicChan <- picDetail
-					}
-				}
-			} else {
-				mutex.Unlock()
+// 作者作品详情每次请求的数量
+const authorPageSize = 48
+
+// 根据作者ID爬取其所有图片
+func AuthorStrategy(ctx context.Context, p *pixiv.Pixiv) error {
+	authorId, _ := url.QueryUnescape(p.KeyWord)
+	// 通过此接口获取作者名，作为文件夹根目录
+	author := &pixiv.UserDetail{}
+	if err := getJson(ctx, p, "https://www.pixiv.net/ajax/user/"+authorId, author); err != nil {
+		return fmt.Errorf("作者信息获取失败: %v", err)
+	}
+	baseGroup := dirName(author.Body.Name, authorId)
+
+	// 获取作者所有插画和漫画的ID
+	profile := &pixiv.ProfileAll{}
+	if err := getJson(ctx, p, "https://www.pixiv.net/ajax/user/"+authorId+"/profile/all", profile); err != nil {
+		return fmt.Errorf("作者作品列表获取失败: %v", err)
+	}
+	ids := append(profile.Body.Illusts.Ids(), profile.Body.Manga.Ids()...)
+	log.Println(baseGroup, " 共 ", len(ids), "张待选, ", (len(ids)+authorPageSize-1)/authorPageSize, " 页待爬取")
+
+	var num int64 = 0
+	failed := 0
+	for start := 0; start < len(ids); start += authorPageSize {
+		if ctx.Err() != nil {
+			break
+		}
+		end := start + authorPageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		// 分页获取作品的详细信息
+		urlStr := "https://www.pixiv.net/ajax/user/" + authorId +
+			"/profile/illusts?work_category=illustManga&is_first_page=0"
+		for _, id := range ids[start:end] {
+			urlStr += "&ids%5B%5D=" + id
+		}
+		works := &pixiv.ProfileWorks{}
+		if err := getJson(ctx, p, urlStr, works); err != nil {
+			log.Println("作者作品详情获取失败", err)
+			if ctx.Err() == nil {
+				failed++
 			}
-			wait.Add(1)
-			go func(id string) {
-				for _, detail2 := range getRelevanceUrls(p, id, 100, 3) {
-					mutex.Lock()
-					if !complete[detail2.Id] && (p.RepetitionOdds > 0 || !p.Memo[detail2.Id]) {
-						complete[detail2.Id] = true
-						mutex.Unlock()
-						if atomic.LoadInt32(&p.IsCancel) == 0 {
-							picDetail, flag := process(p, &detail2, true)
-							if flag && atomic.LoadInt32(&p.IsCancel) == 0 {
-								p.PicChan <- picDetail
-							}
-						}
-					} else {
-						mutex.Unlock()
-					}
-					for _, detail3 := range getRelevanceUrls(p, id, 50, 3) {
-						mutex.Lock()
-						if !complete[detail3.Id] && (p.RepetitionOdds > 0 || !p.Memo[detail3.Id]) {
-							complete[detail3.Id] = true
-							mutex.Unlock()
-							if atomic.LoadInt32(&p.IsCancel) == 0 {
-								picDetail, flag := process(p, &detail3, true)
-								if flag && atomic.LoadInt32(&p.IsCancel) == 0 {
-									p.PicChan <- picDetail
-								}
-							}
-						} else {
-							mutex.Unlock()
-						}
-					}
+			continue
+		}
+		// 每页解析是否爬取并行
+		countdown := sync.WaitGroup{}
+		for _, detail := range works.Body.Works {
+			// 不爬已经爬过的
+			if p.RepetitionOdds == 0 && p.IsDownloaded(detail.Id) {
+				continue
+			}
+			// 正在执行任务计数
+			countdown.Add(1)
+			go func(detail pixiv.Illust) {
+				picDetail, flag := process(ctx, p, &detail)
+				if flag {
+					picDetail.Group = baseGroup + "/" + picDetail.Group
+					atomic.AddInt64(&num, 1)
+					p.Submit(ctx, picDetail)
 				}
-				wait.Done()
-			}(detail.Id)
+				countdown.Done()
+			}(detail)
 		}
+		// 等待任务执行完成
+		countdown.Wait()
+	}
+	log.Println(baseGroup, " 共筛选出 ", atomic.LoadInt64(&num), " 张")
+	if failed > 0 {
+		return fmt.Errorf("%s 有 %d 页作品详情获取失败", baseGroup, failed)
 	}
-	wait.Wait()
+	return nil
 }
 
-// 根据作者ID爬取其所有图片
-func AuthorStrategy(p *pixiv.Pixiv) {
-	log.Println("暂不支持")
+// 请求pixiv接口并将返回的json解析到v中
+func getJson(ctx context.Context, p *pixiv.Pixiv, urlStr string, v interface{}) error {
+	return getJsonRetry(ctx, p, pixiv.RetryDefault, urlStr, v)
 }
 
-// 获取图片Id的相关图片
-func getRelevanceUrls(p *pixiv.Pixiv, imgId string, limit int, tryTimes int) []pixiv.Illust {
-	var res []pixiv.Illust
-	originUrl := "https://www.pixiv.net/ajax/illust/" + imgId +
-		"/recommend/init?limit=" + strconv.Itoa(limit)
+// 同 getJson, 使用调用处site的重试次数
+func getJsonRetry(ctx context.Context, p *pixiv.Pixiv, site, urlStr string, v interface{}) error {
+	_, err := fetchJson(ctx, p, site, "", urlStr, v)
+	return err
+}
+
+// 账号在爬取过程中被停用
+var errAccountDisabled = errors.New("账号已停用")
+
+// 收藏、关注等与账号相关的爬取使用的账号, 在开始时固定, 停用后停止爬取而不是换到其他账号
+type userAccount struct {
+	cookie string
+	userId string
+}
 
+// 固定当前账号并获取其用户ID
+func currentAccount(ctx context.Context, p *pixiv.Pixiv) (*userAccount, error) {
+	cookie := p.UserCookie()
+	if p.Accounts != nil && len(cookie) == 0 {
+		return nil, errors.New("没有可用的账号")
+	}
+	userId, err := p.UserIdAs(ctx, cookie)
+	if err != nil {
+		return nil, err
+	}
+	return &userAccount{cookie: cookie, userId: userId}, nil
+}
+
+// 使用固定的账号(而不是账号池中轮流选择的账号)请求, 账号已停用时返回 errAccountDisabled
+func (a *userAccount) getJson(ctx context.Context, p *pixiv.Pixiv, urlStr string, v interface{}) error {
+	if !p.AccountHealthy(a.cookie) {
+		return fmt.Errorf("%w: %s", errAccountDisabled, a.userId)
+	}
+	_, err := fetchJson(ctx, p, pixiv.RetryDefault, a.cookie, urlStr, v)
+	if err != nil && !p.AccountHealthy(a.cookie) {
+		return fmt.Errorf("%w: %s", errAccountDisabled, a.userId)
+	}
+	return err
+}
+
+// getJson 的实现, cookie为空时由账号池轮流选择
+// 返回的响应已关闭, 只用于确认请求使用的账号
+func fetchJson(ctx context.Context, p *pixiv.Pixiv, site, cookie, urlStr string, v interface{}) (*http.Response, error) {
 	header := &http.Header{}
 	header.Add("user-agent", pixiv.GetRandomUserAgent())
-	header.Add("cookie", p.Cookie)
-	nowUrl, _ := url.Parse(originUrl)
+	if len(cookie) > 0 {
+		header.Add("cookie", cookie)
+	}
+	nowUrl, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
 	request := &http.Request{
 		Method: "GET",
 		URL:    nowUrl,
 		Header: *header,
 	}
-	resp, err := p.DoRequest(request)
+	resp, err := p.DoRequestRetry(ctx, request, site)
 	if err != nil {
-		if tryTimes > 0 {
-			return getRelevanceUrls(p, imgId, limit, tryTimes-1)
-		}
-		log.Println("相关图片爬取失败", err)
-		return nil
+		return nil, err
 	}
+	defer resp.Body.Close()
+	// pixiv接口出错时通常也会返回json, 只有解析失败时才报告状态码
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil && resp.StatusCode != http.StatusOK {
+		return resp, errors.New(resp.Status)
+	}
+	return resp, err
+}
+
+// 获取图片Id的相关图片
+func getRelevanceUrls(ctx context.Context, p *pixiv.Pixiv, imgId string, limit int) ([]pixiv.Illust, error) {
+	originUrl := "https://www.pixiv.net/ajax/illust/" + imgId +
+		"/recommend/init?limit=" + strconv.Itoa(limit)
 	var details = &pixiv.UrlDetail2{}
-	json.NewDecoder(resp.Body).Decode(details)
-	resp.Body.Close()
-	res = append(res, details.Body.Illusts...)
-	return res
+	if err := getJsonRetry(ctx, p, pixiv.RetryRelated, originUrl, details); err != nil {
+		log.Println("相关图片爬取失败", err)
+		return nil, err
+	}
+	return details.Body.Illusts, nil
 }
 
-// 根据图片原始信息加工成要爬取的图片信息
-func process(p *pixiv.Pixiv, detail *pixiv.Illust, bookMark bool) (*pixiv.PicDetail, bool) {
+// 根据图片原始信息加工成要爬取的图片信息, 按筛选规则决定是否爬取以及保存的分组
+func process(ctx context.Context, p *pixiv.Pixiv, detail *pixiv.Illust) (*pixiv.PicDetail, bool) {
+	p.EmitDiscovered(detail)
 
-	pic := &pixiv.PicDetail{
-		Id:    detail.Id,
-		Url:   detail.Url,
-		Group: "",
-	}
-	for _, tag := range detail.Tags {
-		if strings.Contains(strings.ToLower(tag), "r-18") {
-			pic.Group += "R-18/"
-			if !p.R18 {
-				return nil, false
-			}
+	// 目标显示器模式下先按分辨率筛选, 避免无用的详情请求
+	var displays []string
+	if len(p.Displays) > 0 {
+		if displays = p.MatchDisplays(detail.Width, detail.Height); len(displays) == 0 {
+			p.EmitFiltered(detail, "不适合任何显示器 "+strconv.Itoa(detail.Width)+"x"+strconv.Itoa(detail.Height))
+			return nil, false
 		}
 	}
-	flag := false
-	h := detail.Height
-	w := detail.Width
-	isWidth := w > h
-	var max, min int
-	if w > h {
-		max, min = w, h
-	} else {
-		min, max = w, h
+	group, reason, ok := p.ApplyRules(ctx, detail)
+	if !ok {
+		p.EmitFiltered(detail, reason)
+		return nil, false
 	}
-	ratio := float32(max) / float32(min)
-	pic.Ratio = ratio
-	if max >= 1750 && min >= 900 {
-		if ratio < 2.15 && ratio > 1.4 {
-			if isWidth {
-				if strings.Contains(p.PicType, "w") {
-					pic.Group += "宽屏"
-					flag = true
-				}
-			} else {
-				if strings.Contains(p.PicType, "h") {
-					pic.Group += "竖屏"
-					flag = true
-				}
-			}
-		} else {
-			if strings.Contains(p.PicType, "o") {
-				pic.Group += "其他"
-				flag = true
-			}
-		}
-	} else {
-		if strings.Contains(p.PicType, "s") {
-			pic.Group += "小屏"
-			flag = true
-		}
+	pic := newPicDetail(detail)
+	pic.Group = group
+	pic.Displays = displays
+	max, min := detail.Width, detail.Height
+	if min > max {
+		max, min = min, max
 	}
+	pic.Ratio = float32(max) / float32(min)
+	return pic, true
+}
 
-	if flag && bookMark {
-		// 如果需要计算点赞数则进行计算
-		header := &http.Header{}
-		header.Add("user-agent", pixiv.GetRandomUserAgent())
-		header.Add("cookie", p.Cookie)
-		nowUrl, _ := url.Parse("https://www.pixiv.net/artworks/" + detail.Id)
-		request := &http.Request{
-			Method: "GET",
-			URL:    nowUrl,
-			Header: *header,
-		}
-		resp, err := p.DoRequest(request)
-		if err != nil {
-			return nil, false
-		}
-		bytes, _ := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		respStr := fmt.Sprintf("%s", bytes)
-		split := strings.Split(respStr, "bookmarkCount\":")
-		if len(split) < 2 {
-			return nil, false
-		}
-		detail.BookmarkData, _ = strconv.Atoi(
-			strings.Split(split[1], ",")[0])
-		if err != nil {
-			return nil, false
-		}
-		// 点赞数不符合
-		if detail.BookmarkData < p.Bookmarks {
-			return pic, false
+// 根据作品信息生成待下载的图片信息, 分组为空
+func newPicDetail(detail *pixiv.Illust) *pixiv.PicDetail {
+	return &pixiv.PicDetail{
+		Id:         detail.Id,
+		Url:        detail.Url,
+		Title:      detail.Title,
+		UserId:     detail.UserId,
+		UserName:   detail.UserName,
+		Tags:       detail.Tags,
+		Width:      detail.Width,
+		Height:     detail.Height,
+		Bookmarks:  detail.BookmarkData,
+		PageCount:  detail.PageCount,
+		IllustType: detail.IllustType,
+	}
+}
+
+// 用作目录名的名称: 替换路径分隔符和 windows 下不能用于文件名的字符, 去掉首尾的空格和点
+// 处理后为空时使用fallback
+func dirName(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < ' ' || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
 		}
+		return r
+	}, name)
+	name = strings.Trim(name, " .")
+	if len(name) == 0 {
+		return fallback
 	}
-	return pic, flag
+	return name
 }
 
 func getMinBookMark(bookmark int) int {
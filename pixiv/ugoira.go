@@ -0,0 +1,315 @@
+package pixiv
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// 动图作品的illustType
+const UgoiraType = 2
+
+// 同时合成的动图数, 合成时所有帧都在内存中
+const ugoiraConcurrency = 2
+
+// 动图元信息
+type UgoiraMeta struct {
+	Error bool
+	Body  struct {
+		Src         string
+		OriginalSrc string
+		MimeType    string `json:"mime_type"`
+		Frames      []UgoiraFrame
+	}
+}
+
+// 动图每一帧的文件名和延时(毫秒)
+type UgoiraFrame struct {
+	File  string `json:"file"`
+	Delay int    `json:"delay"`
+}
+
+// 下载动图: 保存原始zip和帧时间信息, 并根据UgoiraFormat合成gif/apng
+func (p *Pixiv) downloadUgoira(ctx context.Context, detail *PicDetail) error {
+	meta, err := p.getUgoiraMeta(ctx, detail.Id)
+	if err != nil {
+		return fmt.Errorf("动图信息获取失败: %v", err)
+	}
+	zipUrl := meta.Body.OriginalSrc
+	if len(zipUrl) == 0 {
+		zipUrl = meta.Body.Src
+	}
+
+	bathPath := p.GroupDir(detail.Group)
+	if err = os.MkdirAll(bathPath, 0755); err != nil {
+		return err
+	}
+	// 原始压缩包和帧时间信息用于无损存档
+	err = p.download(ctx, &download{
+		Url:          zipUrl,
+		Referer:      referUrl + detail.Id,
+		Path:         bathPath + detail.Id + ".zip",
+		ContentTypes: []string{"application/zip", "application/octet-stream"},
+		Verify:       verifyZip,
+	})
+	if err != nil {
+		return fmt.Errorf("动图压缩包下载失败: %v", err)
+	}
+	frames, _ := json.MarshalIndent(meta.Body.Frames, "", "  ")
+	if err = writeFileAtomic(bathPath+detail.Id+".json", frames); err != nil {
+		return err
+	}
+	detail.addFile(bathPath+detail.Id+".zip", zipUrl)
+	detail.addFile(bathPath+detail.Id+".json", "")
+
+	format := strings.ToLower(p.UgoiraFormat)
+	if !strings.Contains(format, "gif") && !strings.Contains(format, "apng") {
+		return nil
+	}
+	select {
+	case p.ugoiraPool <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-p.ugoiraPool }()
+	data, err := ioutil.ReadFile(bathPath + detail.Id + ".zip")
+	if err != nil {
+		return err
+	}
+	images, err := decodeUgoiraFrames(data, meta.Body.Frames)
+	if err != nil {
+		return fmt.Errorf("动图解析失败: %v", err)
+	}
+	delays := make([]int, len(meta.Body.Frames))
+	for i, frame := range meta.Body.Frames {
+		delays[i] = frame.Delay
+	}
+	if strings.Contains(format, "gif") {
+		if err = writeAnimation(bathPath+detail.Id+".gif", images, delays, EncodeGif); err != nil {
+			return fmt.Errorf("gif合成失败: %v", err)
+		}
+		detail.addFile(bathPath+detail.Id+".gif", "")
+	}
+	if strings.Contains(format, "apng") {
+		if err = writeAnimation(bathPath+detail.Id+".png", images, delays, EncodeApng); err != nil {
+			return fmt.Errorf("apng合成失败: %v", err)
+		}
+		detail.addFile(bathPath+detail.Id+".png", "")
+	}
+	return nil
+}
+
+// 获取动图元信息
+func (p *Pixiv) getUgoiraMeta(ctx context.Context, id string) (*UgoiraMeta, error) {
+	header := &http.Header{}
+	header.Add("user-agent", GetRandomUserAgent())
+	header.Add("referer", referUrl+id)
+	metaUrl, _ := url.Parse("https://www.pixiv.net/ajax/illust/" + id + "/ugoira_meta")
+	request := &http.Request{
+		Method: "GET",
+		URL:    metaUrl,
+		Header: *header,
+	}
+	resp, err := p.DoRequest(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	meta := &UgoiraMeta{}
+	if err = json.NewDecoder(resp.Body).Decode(meta); err != nil {
+		return nil, err
+	}
+	if meta.Error || len(meta.Body.Frames) == 0 {
+		return nil, errors.New("ugoira_meta 返回为空")
+	}
+	return meta, nil
+}
+
+// 按帧信息的顺序解码压缩包中的每一帧
+func decodeUgoiraFrames(data []byte, frames []UgoiraFrame) ([]image.Image, error) {
+	reader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, file := range reader.File {
+		files[path.Base(file.Name)] = file
+	}
+	images := make([]image.Image, 0, len(frames))
+	for _, frame := range frames {
+		file, ok := files[frame.File]
+		if !ok {
+			return nil, errors.New("压缩包中缺少帧 " + frame.File)
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := image.Decode(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// 合成动图并写入文件, 先写入临时文件, 成功后再重命名
+func writeAnimation(name string, images []image.Image, delays []int,
+	encode func(io.Writer, []image.Image, []int) error) error {
+	var buf bytes.Buffer
+	if err := encode(&buf, images, delays); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, buf.Bytes())
+}
+
+// 校验下载的压缩包是否完整
+func verifyZip(name string) error {
+	reader, err := zip.OpenReader(name)
+	if err != nil {
+		return fmt.Errorf("压缩包解析失败: %v", err)
+	}
+	return reader.Close()
+}
+
+// 合成gif, delays单位为毫秒
+func EncodeGif(w io.Writer, images []image.Image, delays []int) error {
+	anim := &gif.GIF{}
+	for i, img := range images {
+		bounds := img.Bounds()
+		paletted := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(paletted, bounds, img, bounds.Min)
+		anim.Image = append(anim.Image, paletted)
+		// gif的延时单位为10毫秒
+		anim.Delay = append(anim.Delay, (delays[i]+5)/10)
+	}
+	return gif.EncodeAll(w, anim)
+}
+
+// 合成apng, delays单位为毫秒
+// 每一帧都转换为NRGBA并按RGBA颜色类型编码, 不透明和透明的帧混合时颜色类型也一致
+func EncodeApng(w io.Writer, images []image.Image, delays []int) error {
+	if len(images) == 0 {
+		return errors.New("没有可合成的帧")
+	}
+	first := images[0].Bounds()
+	var sequence uint32
+	chunks := &bytes.Buffer{}
+	for i, img := range images {
+		bounds := img.Bounds()
+		if bounds.Dx() != first.Dx() || bounds.Dy() != first.Dy() {
+			return errors.New("动图各帧的尺寸不一致")
+		}
+		idat, err := encodeRgba(img)
+		if err != nil {
+			return err
+		}
+
+		// fcTL: 帧控制块
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:], sequence)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		delay := delays[i]
+		if delay > 0xffff {
+			delay = 0xffff
+		}
+		binary.BigEndian.PutUint16(fctl[20:], uint16(delay))
+		binary.BigEndian.PutUint16(fctl[22:], 1000)
+		writeChunk(chunks, "fcTL", fctl)
+		sequence++
+		if i == 0 {
+			writeChunk(chunks, "IDAT", idat)
+			continue
+		}
+		// 之后的帧使用fdAT, 数据前加上序号
+		fdat := make([]byte, 4+len(idat))
+		binary.BigEndian.PutUint32(fdat, sequence)
+		copy(fdat[4:], idat)
+		writeChunk(chunks, "fdAT", fdat)
+		sequence++
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString("\x89PNG\r\n\x1a\n")
+	// IHDR: 宽高, 8位深度, 颜色类型6(RGBA), 默认压缩和滤波方式, 不交错
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(first.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(first.Dy()))
+	ihdr[8], ihdr[9] = 8, 6
+	writeChunk(out, "IHDR", ihdr)
+	// acTL: 帧数以及无限循环
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl, uint32(len(images)))
+	writeChunk(out, "acTL", actl)
+	out.Write(chunks.Bytes())
+	writeChunk(out, "IEND", nil)
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// 将图片转换为NRGBA后压缩为png的图像数据, 每行使用Sub滤波
+func encodeRgba(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	buf := &bytes.Buffer{}
+	writer := zlib.NewWriter(buf)
+	width := bounds.Dx() * 4
+	line := make([]byte, 1+width)
+	for y := 0; y < bounds.Dy(); y++ {
+		row := nrgba.Pix[y*nrgba.Stride : y*nrgba.Stride+width]
+		// Sub滤波: 每个字节减去左边像素的同一通道
+		line[0] = 1
+		for x := 0; x < width; x++ {
+			left := byte(0)
+			if x >= 4 {
+				left = row[x-4]
+			}
+			line[1+x] = row[x] - left
+		}
+		if _, err := writer.Write(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// 写入一个png数据块: 长度 + 类型 + 数据 + crc
+func writeChunk(w *bytes.Buffer, name string, data []byte) {
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint32(head, uint32(len(data)))
+	copy(head[4:], name)
+	w.Write(head)
+	w.Write(data)
+	crc := crc32.NewIEEE()
+	crc.Write(head[4:])
+	crc.Write(data)
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc.Sum32())
+	w.Write(sum)
+}
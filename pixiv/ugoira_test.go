@@ -0,0 +1,112 @@
+package pixiv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// 按顺序列出png中的数据块类型
+func pngChunks(t *testing.T, data []byte) []string {
+	if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+		t.Fatal("缺少png文件头")
+	}
+	var names []string
+	for rest := data[8:]; len(rest) > 0; {
+		if len(rest) < 12 {
+			t.Fatal("数据块不完整")
+		}
+		size := int(binary.BigEndian.Uint32(rest))
+		names = append(names, string(rest[4:8]))
+		rest = rest[12+size:]
+	}
+	return names
+}
+
+func filled(img interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}, c color.Color) image.Image {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestEncodeApng(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+	clear := color.NRGBA{G: 255, A: 128}
+	tests := []struct {
+		name   string
+		images []image.Image
+		chunks []string
+		// 第一帧左上角的颜色, 普通的png解码器只解码第一帧
+		first color.NRGBA
+	}{
+		{"单帧", []image.Image{filled(image.NewRGBA(image.Rect(0, 0, 3, 2)), red)},
+			[]string{"IHDR", "acTL", "fcTL", "IDAT", "IEND"}, red},
+		{"不透明和透明的帧混合", []image.Image{
+			filled(image.NewRGBA(image.Rect(0, 0, 3, 2)), red),
+			filled(image.NewNRGBA(image.Rect(0, 0, 3, 2)), clear),
+			filled(image.NewGray(image.Rect(0, 0, 3, 2)), color.Gray{Y: 10}),
+		}, []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "fcTL", "fdAT", "IEND"}, red},
+		{"透明的第一帧", []image.Image{
+			filled(image.NewNRGBA(image.Rect(0, 0, 3, 2)), clear),
+			filled(image.NewRGBA(image.Rect(0, 0, 3, 2)), red),
+		}, []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "IEND"}, clear},
+		{"起点不是原点的帧", []image.Image{filled(image.NewRGBA(image.Rect(5, 5, 8, 7)), red)},
+			[]string{"IHDR", "acTL", "fcTL", "IDAT", "IEND"}, red},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delays := make([]int, len(test.images))
+			for i := range delays {
+				delays[i] = 100
+			}
+			var buf bytes.Buffer
+			if err := EncodeApng(&buf, test.images, delays); err != nil {
+				t.Fatal(err)
+			}
+			if chunks := pngChunks(t, buf.Bytes()); !reflect.DeepEqual(chunks, test.chunks) {
+				t.Fatalf("数据块 = %v, want %v", chunks, test.chunks)
+			}
+			img, err := png.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds().Dx() != 3 || img.Bounds().Dy() != 2 {
+				t.Errorf("尺寸 = %v, want 3x2", img.Bounds())
+			}
+			nrgba, ok := img.(*image.NRGBA)
+			if !ok {
+				t.Fatalf("解码为 %T, want *image.NRGBA", img)
+			}
+			if got := nrgba.NRGBAAt(2, 1); got != test.first {
+				t.Errorf("第一帧颜色 = %v, want %v", got, test.first)
+			}
+		})
+	}
+}
+
+func TestEncodeApngInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		images []image.Image
+	}{
+		{"没有帧", nil},
+		{"尺寸不一致", []image.Image{image.NewRGBA(image.Rect(0, 0, 3, 2)), image.NewRGBA(image.Rect(0, 0, 2, 3))}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := EncodeApng(&buf, test.images, make([]int, len(test.images))); err == nil {
+			t.Errorf("%s: EncodeApng 没有返回错误", test.name)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package pixiv
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// 裁剪方式
+const (
+	// 居中裁剪
+	CropCenter = "center"
+	// 保留灰度信息熵最大的区域
+	CropEntropy = "entropy"
+	// 保留边缘(梯度)最多的区域
+	CropSaliency = "saliency"
+)
+
+// 壁纸目录, 位于图片根目录下
+const wallpaperDir = "wallpapers"
+
+// 计算裁剪位置时缩小到的最大边长
+const analyzeSize = 256
+
+// 壁纸后处理参数: 将原图裁剪到目标宽高比并缩放到目标分辨率, 原图保持不变
+type WallpaperOptions struct {
+	// 目标分辨率, 输出到 wallpapers/<名称>/
+	Targets []Display
+	// 裁剪方式 center, entropy 或 saliency
+	Crop string
+	// 最多裁掉的面积比例, 超过时不生成该分辨率
+	MaxCrop float64
+	// jpeg质量 1 - 100
+	Quality int
+}
+
+// 默认参数: 居中裁剪, 最多裁掉40%, jpeg质量92
+func DefaultWallpaperOptions(targets []Display) *WallpaperOptions {
+	return &WallpaperOptions{
+		Targets: targets,
+		Crop:    CropCenter,
+		MaxCrop: 0.4,
+		Quality: 92,
+	}
+}
+
+// 解析壁纸参数, targets 格式同 ParseDisplays, 为空时返回nil表示不生成壁纸
+func ParseWallpaperOptions(targets, crop string) (*WallpaperOptions, error) {
+	displays, err := ParseDisplays(targets, 0)
+	if err != nil || len(displays) == 0 {
+		return nil, err
+	}
+	options := DefaultWallpaperOptions(displays)
+	if len(crop) > 0 {
+		options.Crop = crop
+	}
+	return options, options.Validate()
+}
+
+// 校验参数
+func (o *WallpaperOptions) Validate() error {
+	switch o.Crop {
+	case CropCenter, CropEntropy, CropSaliency:
+	default:
+		return fmt.Errorf("裁剪方式只能为 center, entropy 或 saliency: %s", o.Crop)
+	}
+	if o.MaxCrop < 0 || o.MaxCrop >= 1 {
+		return fmt.Errorf("最多裁掉的面积比例必须在 0 - 1 之间: %v", o.MaxCrop)
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("jpeg质量必须在 1 - 100 之间: %d", o.Quality)
+	}
+	return nil
+}
+
+// 壁纸根目录
+func (p *Pixiv) WallpaperDir() string {
+	return filepath.Join(p.RootDir(), wallpaperDir)
+}
+
+// 为下载完成的作品生成壁纸, 动图不处理
+// 解码和缩放原图占用内存较多, 交给单独的协程处理, 同时处理的数量不超过CPU数, 不占用下载的并发数
+// ctx取消时还没开始的壁纸不再生成, 之后可以用 wallpaper 命令补齐
+func (p *Pixiv) makeWallpapers(ctx context.Context, detail *PicDetail) {
+	if p.Wallpaper == nil || detail.IllustType == UgoiraType {
+		return
+	}
+	p.wallpaperWait.Add(1)
+	go func() {
+		defer p.wallpaperWait.Done()
+		select {
+		case p.wallpaperPool <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		defer func() { <-p.wallpaperPool }()
+		for _, file := range detail.Files {
+			if _, err := MakeWallpapers(file.Path, p.WallpaperDir(), p.Wallpaper); err != nil {
+				log.Println(detail.Id, " 壁纸生成失败 ", err)
+			}
+		}
+	}()
+}
+
+// 是否是可以处理的图片
+func IsWallpaperSource(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png":
+		return true
+	}
+	return false
+}
+
+// 将图片裁剪缩放为各目标分辨率的壁纸, 保存到 dir/<名称>/<原文件名>.jpg
+// 已存在的壁纸跳过, 返回新生成的数量
+func MakeWallpapers(src, dir string, options *WallpaperOptions) (int, error) {
+	if !IsWallpaperSource(src) {
+		return 0, nil
+	}
+	base := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src)) + ".jpg"
+	var img image.Image
+	made := 0
+	for _, target := range options.Targets {
+		out := filepath.Join(dir, target.Name, base)
+		if _, err := os.Stat(out); err == nil {
+			continue
+		}
+		// 需要生成时才解码原图
+		if img == nil {
+			file, err := os.Open(src)
+			if err != nil {
+				return made, err
+			}
+			img, _, err = image.Decode(file)
+			file.Close()
+			if err != nil {
+				return made, fmt.Errorf("%s 解码失败: %v", src, err)
+			}
+		}
+		rect, ok := cropRect(img, target, options)
+		if !ok {
+			continue
+		}
+		resized := resize(img, rect, target.Width, target.Height)
+		if err := saveJpeg(out, resized, options.Quality); err != nil {
+			return made, err
+		}
+		made++
+	}
+	return made, nil
+}
+
+// 计算裁剪区域, 裁剪后分辨率不足或裁掉太多时返回false
+func cropRect(img image.Image, target Display, options *WallpaperOptions) (image.Rectangle, bool) {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	ratio := float64(target.Width) / float64(target.Height)
+	cw, ch := w, h
+	if float64(w)/float64(h) > ratio {
+		cw = int(math.Round(float64(h) * ratio))
+	} else {
+		ch = int(math.Round(float64(w) / ratio))
+	}
+	if cw < target.Width || ch < target.Height {
+		return image.Rectangle{}, false
+	}
+	if 1-float64(cw*ch)/float64(w*h) > options.MaxCrop {
+		return image.Rectangle{}, false
+	}
+	// 只有一个方向需要裁剪
+	horizontal := cw < w
+	length, window := h, ch
+	if horizontal {
+		length, window = w, cw
+	}
+	offset := (length - window) / 2
+	if options.Crop != CropCenter && length > window {
+		offset = bestOffset(img, horizontal, window, options.Crop)
+	}
+	if horizontal {
+		return image.Rect(bounds.Min.X+offset, bounds.Min.Y, bounds.Min.X+offset+cw, bounds.Max.Y), true
+	}
+	return image.Rect(bounds.Min.X, bounds.Min.Y+offset, bounds.Max.X, bounds.Min.Y+offset+ch), true
+}
+
+// 在缩小后的灰度图上滑动窗口, 找到得分最高的裁剪位置
+func bestOffset(img image.Image, horizontal bool, window int, mode string) int {
+	bounds := img.Bounds()
+	length := bounds.Dy()
+	if horizontal {
+		length = bounds.Dx()
+	}
+	scale := float64(analyzeSize) / math.Max(float64(bounds.Dx()), float64(bounds.Dy()))
+	if scale > 1 {
+		scale = 1
+	}
+	sw := int(math.Max(1, math.Round(float64(bounds.Dx())*scale)))
+	sh := int(math.Max(1, math.Round(float64(bounds.Dy())*scale)))
+	small := resize(img, bounds, sw, sh)
+	gray := make([][]float64, sh)
+	for y := 0; y < sh; y++ {
+		gray[y] = make([]float64, sw)
+		for x := 0; x < sw; x++ {
+			i := small.PixOffset(x, y)
+			r, g, b := float64(small.Pix[i]), float64(small.Pix[i+1]), float64(small.Pix[i+2])
+			gray[y][x] = 0.299*r + 0.587*g + 0.114*b
+		}
+	}
+	// 沿裁剪方向的每一条像素线
+	lines, across := sh, sw
+	if horizontal {
+		lines, across = sw, sh
+	}
+	at := func(line, pos int) float64 {
+		if horizontal {
+			return gray[pos][line]
+		}
+		return gray[line][pos]
+	}
+	smallWindow := int(math.Round(float64(window) * float64(lines) / float64(length)))
+	if smallWindow >= lines {
+		return (length - window) / 2
+	}
+
+	best, bestScore := 0, math.Inf(-1)
+	if mode == CropSaliency {
+		// 每条线的梯度和, 用前缀和计算窗口得分
+		prefix := make([]float64, lines+1)
+		for line := 0; line < lines; line++ {
+			sum := 0.0
+			for pos := 0; pos < across; pos++ {
+				if line+1 < lines {
+					sum += math.Abs(at(line+1, pos) - at(line, pos))
+				}
+				if pos+1 < across {
+					sum += math.Abs(at(line, pos+1) - at(line, pos))
+				}
+			}
+			prefix[line+1] = prefix[line] + sum
+		}
+		for start := 0; start+smallWindow <= lines; start++ {
+			if score := prefix[start+smallWindow] - prefix[start]; score > bestScore {
+				best, bestScore = start, score
+			}
+		}
+	} else {
+		// 每条线的灰度直方图前缀和, 计算窗口内的信息熵
+		const bins = 32
+		prefix := make([][bins]int, lines+1)
+		for line := 0; line < lines; line++ {
+			prefix[line+1] = prefix[line]
+			for pos := 0; pos < across; pos++ {
+				prefix[line+1][int(at(line, pos))*bins/256]++
+			}
+		}
+		total := float64(smallWindow * across)
+		for start := 0; start+smallWindow <= lines; start++ {
+			entropy := 0.0
+			for bin := 0; bin < bins; bin++ {
+				if count := prefix[start+smallWindow][bin] - prefix[start][bin]; count > 0 {
+					p := float64(count) / total
+					entropy -= p * math.Log2(p)
+				}
+			}
+			if entropy > bestScore {
+				best, bestScore = start, entropy
+			}
+		}
+	}
+	offset := int(math.Round(float64(best) * float64(length) / float64(lines)))
+	if offset > length-window {
+		offset = length - window
+	}
+	return offset
+}
+
+// 将图片的rect区域缩放到 width x height, 使用按缩放比例展宽的三角形滤波, 缩小时不会产生锯齿
+// 逐行从原图读取并水平缩放, 只缓存垂直缩放还需要的几行, 不复制整张原图
+func resize(img image.Image, rect image.Rectangle, width, height int) *image.RGBA {
+	xWeights := filterWeights(rect.Dx(), width)
+	yWeights := filterWeights(rect.Dy(), height)
+	line := make([]uint8, rect.Dx()*4)
+	rows := make(map[int][]float32)
+	var free [][]float32
+	// 水平缩放后的第y行
+	scaled := func(y int) []float32 {
+		if row, ok := rows[y]; ok {
+			return row
+		}
+		var row []float32
+		if n := len(free); n > 0 {
+			row, free = free[n-1], free[:n-1]
+		} else {
+			row = make([]float32, width*4)
+		}
+		readRow(img, rect, y, line)
+		for x, weights := range xWeights {
+			var r, g, b float32
+			for _, w := range weights {
+				i := w.index * 4
+				r += float32(line[i]) * w.weight
+				g += float32(line[i+1]) * w.weight
+				b += float32(line[i+2]) * w.weight
+			}
+			row[x*4], row[x*4+1], row[x*4+2] = r, g, b
+		}
+		rows[y] = row
+		return row
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	sum := make([]float32, width*4)
+	for y, weights := range yWeights {
+		// 输出行对应的输入行单调递增, 之前的行不再需要
+		first := weights[0].index
+		for _, w := range weights {
+			if w.index < first {
+				first = w.index
+			}
+		}
+		for index, row := range rows {
+			if index < first {
+				delete(rows, index)
+				free = append(free, row)
+			}
+		}
+		for i := range sum {
+			sum[i] = 0
+		}
+		for _, w := range weights {
+			row := scaled(w.index)
+			for i := range sum {
+				sum[i] += row[i] * w.weight
+			}
+		}
+		pix := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			i := x * 4
+			pix[i], pix[i+1], pix[i+2], pix[i+3] = clampUint8(sum[i]), clampUint8(sum[i+1]), clampUint8(sum[i+2]), 255
+		}
+	}
+	return dst
+}
+
+// 读取rect区域的第y行到line(RGBA), 透明背景填充为白色; 常见格式直接读取像素数组
+func readRow(img image.Image, rect image.Rectangle, y int, line []uint8) {
+	py := rect.Min.Y + y
+	switch src := img.(type) {
+	case *image.YCbCr:
+		for x := 0; x < rect.Dx(); x++ {
+			px := rect.Min.X + x
+			yi, ci := src.YOffset(px, py), src.COffset(px, py)
+			line[x*4], line[x*4+1], line[x*4+2] = color.YCbCrToRGB(src.Y[yi], src.Cb[ci], src.Cr[ci])
+		}
+	case *image.Gray:
+		row := src.Pix[src.PixOffset(rect.Min.X, py):]
+		for x := 0; x < rect.Dx(); x++ {
+			line[x*4], line[x*4+1], line[x*4+2] = row[x], row[x], row[x]
+		}
+	case *image.RGBA:
+		row := src.Pix[src.PixOffset(rect.Min.X, py):]
+		for x := 0; x < rect.Dx(); x++ {
+			i := x * 4
+			// 预乘alpha, 加上白色背景的部分
+			back := 255 - row[i+3]
+			line[i], line[i+1], line[i+2] = row[i]+back, row[i+1]+back, row[i+2]+back
+		}
+	case *image.NRGBA:
+		row := src.Pix[src.PixOffset(rect.Min.X, py):]
+		for x := 0; x < rect.Dx(); x++ {
+			i := x * 4
+			a := uint32(row[i+3])
+			for k := 0; k < 3; k++ {
+				line[i+k] = uint8((uint32(row[i+k])*a + 255*(255-a) + 127) / 255)
+			}
+		}
+	default:
+		for x := 0; x < rect.Dx(); x++ {
+			r, g, b, a := img.At(rect.Min.X+x, py).RGBA()
+			back := 0xffff - a
+			line[x*4], line[x*4+1], line[x*4+2] = uint8((r+back)>>8), uint8((g+back)>>8), uint8((b+back)>>8)
+		}
+	}
+}
+
+// 滤波权重
+type filterWeight struct {
+	index  int
+	weight float32
+}
+
+// 计算每个输出像素对应的输入像素和权重
+func filterWeights(in, out int) [][]filterWeight {
+	scale := float64(in) / float64(out)
+	support := math.Max(1, scale)
+	weights := make([][]filterWeight, out)
+	for o := 0; o < out; o++ {
+		center := (float64(o)+0.5)*scale - 0.5
+		start := int(math.Ceil(center - support))
+		end := int(math.Floor(center + support))
+		var sum float64
+		var list []filterWeight
+		for i := start; i <= end; i++ {
+			w := 1 - math.Abs(float64(i)-center)/support
+			if w <= 0 {
+				continue
+			}
+			index := i
+			if index < 0 {
+				index = 0
+			} else if index >= in {
+				index = in - 1
+			}
+			list = append(list, filterWeight{index: index, weight: float32(w)})
+			sum += w
+		}
+		for i := range list {
+			list[i].weight /= float32(sum)
+		}
+		weights[o] = list
+	}
+	return weights
+}
+
+func clampUint8(v float32) uint8 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// 保存为jpeg: 先写临时文件再重命名, 中断时不会留下不完整的壁纸
+func saveJpeg(name string, img image.Image, quality int) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(file, img, &jpeg.Options{Quality: quality})
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
@@ -0,0 +1,53 @@
+package pixiv
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFilterWeights(t *testing.T) {
+	tests := []struct {
+		in, out int
+		// 每个输出像素最多使用的输入像素数
+		maxTaps int
+	}{
+		{1, 1, 1},
+		{10, 10, 1},
+		{100, 10, 20},
+		{3840, 1920, 4},
+		{7, 3, 6},
+		{10, 100, 2},
+		{1, 5, 2},
+	}
+	for _, test := range tests {
+		weights := filterWeights(test.in, test.out)
+		if len(weights) != test.out {
+			t.Errorf("filterWeights(%d, %d) 有 %d 个输出, want %d", test.in, test.out, len(weights), test.out)
+			continue
+		}
+		for o, list := range weights {
+			if len(list) == 0 || len(list) > test.maxTaps {
+				t.Errorf("filterWeights(%d, %d)[%d] 使用 %d 个输入, want 1 到 %d", test.in, test.out, o, len(list), test.maxTaps)
+			}
+			var sum float64
+			for _, w := range list {
+				if w.index < 0 || w.index >= test.in {
+					t.Errorf("filterWeights(%d, %d)[%d] 的输入下标 %d 越界", test.in, test.out, o, w.index)
+				}
+				if w.weight <= 0 {
+					t.Errorf("filterWeights(%d, %d)[%d] 的权重 %v 不是正数", test.in, test.out, o, w.weight)
+				}
+				sum += float64(w.weight)
+			}
+			if math.Abs(sum-1) > 1e-5 {
+				t.Errorf("filterWeights(%d, %d)[%d] 的权重和为 %v, want 1", test.in, test.out, o, sum)
+			}
+		}
+	}
+	// 尺寸不变时每个输出像素就是对应的输入像素
+	for o, list := range filterWeights(10, 10) {
+		if len(list) != 1 || list[0].index != o {
+			t.Errorf("filterWeights(10, 10)[%d] = %v, want 输入 %d", o, list, o)
+		}
+	}
+}